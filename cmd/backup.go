@@ -58,4 +58,16 @@ func init() {
 	BackupCmd.PersistentFlags().Bool("schema-only", false, "Backup database schema only")
 	BackupCmd.PersistentFlags().Bool("data-only", false, "Backup database data only")
 	BackupCmd.PersistentFlags().StringSliceP("tables", "t", []string{}, "List of tables to include in the backup")
+	BackupCmd.PersistentFlags().StringSlice("schemas", []string{}, "List of schemas to include in the backup")
+	BackupCmd.PersistentFlags().StringSlice("exclude-table", []string{}, "List of tables to exclude from the backup")
+	BackupCmd.PersistentFlags().StringSlice("exclude-schema", []string{}, "List of schemas to exclude from the backup")
+	BackupCmd.PersistentFlags().StringSlice("exclude-table-data", []string{}, "List of tables to back up without their data")
+	BackupCmd.PersistentFlags().StringArray("subset", []string{}, "Root query of a referentially consistent subset, can be repeated (e.g: `customers where created_at > now() - interval '30 days'`)")
+	BackupCmd.PersistentFlags().String("masking-profile", "", "Masking profile used to anonymize data (e.g: `/config/masking.yaml`)")
+	BackupCmd.PersistentFlags().Bool("with-globals", false, "Backup roles, grants and tablespaces alongside the database dumps")
+	BackupCmd.PersistentFlags().Bool("no-role-passwords", false, "Exclude role passwords from the globals backup")
+	BackupCmd.PersistentFlags().Int("concurrency", 0, "Number of databases backed up in parallel (default 1)")
+	BackupCmd.PersistentFlags().StringSlice("job", []string{}, "Run the given jobs of the configuration file immediately, ignoring their cron expression")
+	BackupCmd.PersistentFlags().String("api-listen", "", "Address of the HTTP API in scheduled mode (e.g: `:8080`)")
+	BackupCmd.PersistentFlags().String("metrics-listen", "", "Address of the Prometheus metrics endpoint in scheduled mode (e.g: `:9090`)")
 }
@@ -0,0 +1,71 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package cmd
+
+import (
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/pkg"
+	"github.com/jkaninda/pg-bkup/utils"
+	"github.com/spf13/cobra"
+)
+
+var ConfigCmd = &cobra.Command{
+	Use:     "config",
+	Short:   "Validate or print the backup configuration",
+	Example: utils.ConfigExample,
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the configuration file and environment variables",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			pkg.ValidateConfig(cmd)
+			return
+		}
+		logger.Fatal(`"config validate" accepts no argument`, "args", args)
+	},
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the resolved configuration with secrets redacted",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			pkg.PrintConfig(cmd)
+			return
+		}
+		logger.Fatal(`"config print" accepts no argument`, "args", args)
+	},
+}
+
+func init() {
+	ConfigCmd.PersistentFlags().StringP("config", "c", "", "Configuration file for multi database backup. (e.g: `/backup/config.yaml`)")
+	ConfigCmd.PersistentFlags().StringP("storage", "s", "", "Define storage: local, s3, ssh, ftp, azure")
+	ConfigCmd.PersistentFlags().StringP("cron-expression", "e", "", "Backup cron expression (e.g., `0 0 * * *` or `@daily`)")
+	configValidateCmd.Flags().Bool("test-connection", false, "Test the connection to each database and storage")
+	ConfigCmd.AddCommand(configValidateCmd)
+	ConfigCmd.AddCommand(configPrintCmd)
+}
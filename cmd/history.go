@@ -0,0 +1,54 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package cmd
+
+import (
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/pkg"
+	"github.com/jkaninda/pg-bkup/utils"
+	"github.com/spf13/cobra"
+)
+
+var HistoryCmd = &cobra.Command{
+	Use:     "history",
+	Short:   "Show the history of the backup runs",
+	Example: utils.HistoryExample,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			pkg.ShowHistory(cmd)
+			return
+		}
+		logger.Fatal(`"history" accepts no argument`, "args", args)
+	},
+}
+
+func init() {
+	HistoryCmd.PersistentFlags().String("job", "", "Show the runs of a job")
+	HistoryCmd.PersistentFlags().StringP("storage", "s", "", "Show the runs of a storage")
+	HistoryCmd.PersistentFlags().String("status", "", "Show the runs with a status, success or failed")
+	HistoryCmd.PersistentFlags().String("since", "", "Show the runs since a duration, such as 24h or 7d, or a date, such as 2024-01-02")
+	HistoryCmd.PersistentFlags().IntP("limit", "n", 20, "Maximum number of runs, 0 shows all of them")
+	HistoryCmd.PersistentFlags().StringP("output", "o", "table", "Output format, table or json")
+}
@@ -45,6 +45,7 @@ var MigrateCmd = &cobra.Command{
 
 func init() {
 	MigrateCmd.PersistentFlags().BoolP("all-databases", "a", false, "Migrate all databases")
+	MigrateCmd.PersistentFlags().String("masking-profile", "", "Masking profile used to anonymize data (e.g: `/config/masking.yaml`)")
 	MigrateCmd.PersistentFlags().BoolP("entire-instance", "I", false, "Migrate the entire Postgres instance including roles, tablespaces, and all databases")
 
 }
@@ -50,5 +50,7 @@ func init() {
 	RestoreCmd.PersistentFlags().StringP("file", "f", "", "File name of database")
 	RestoreCmd.PersistentFlags().StringP("storage", "s", "local", "Define storage: local, s3, ssh, ftp")
 	RestoreCmd.PersistentFlags().StringP("path", "P", "", "AWS S3 path without file name. eg: /custom_path or ssh remote path `/home/foo/backup`")
+	RestoreCmd.PersistentFlags().String("globals-file", "", "Globals file (roles, grants and tablespaces) to restore before the database")
+	RestoreCmd.PersistentFlags().Bool("latest", false, "Restore the last successful backup of the database found in the run history")
 
 }
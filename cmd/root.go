@@ -25,6 +25,7 @@
 package cmd
 
 import (
+	"github.com/jkaninda/logger"
 	"github.com/jkaninda/pg-bkup/utils"
 	"github.com/spf13/cobra"
 	"os"
@@ -49,9 +50,21 @@ func Execute() {
 }
 
 func init() {
+	cobra.OnInitialize(loadSecretFiles, utils.CaptureLogs)
 	rootCmd.PersistentFlags().StringP("dbname", "d", "", "Database name")
 	rootCmd.AddCommand(VersionCmd)
 	rootCmd.AddCommand(BackupCmd)
 	rootCmd.AddCommand(RestoreCmd)
+	rootCmd.AddCommand(VerifyCmd)
 	rootCmd.AddCommand(MigrateCmd)
+	rootCmd.AddCommand(ConfigCmd)
+	rootCmd.AddCommand(ServeCmd)
+	rootCmd.AddCommand(HistoryCmd)
+}
+
+// loadSecretFiles reads secrets from the files referenced by *_FILE environment variables
+func loadSecretFiles() {
+	if err := utils.LoadSecretFiles(); err != nil {
+		logger.Fatal("Error loading secret files", "error", err)
+	}
 }
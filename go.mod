@@ -3,6 +3,7 @@ module github.com/jkaninda/pg-bkup
 go 1.24.5
 
 require (
+	github.com/aws/aws-sdk-go v1.55.7
 	github.com/go-mail/mail v2.3.1+incompatible
 	github.com/jackc/pgx/v5 v5.7.6
 	github.com/jkaninda/encryptor v0.0.0-20241111100652-926393c9437e
@@ -21,7 +22,6 @@ require (
 	github.com/ProtonMail/go-crypto v1.3.0 // indirect
 	github.com/ProtonMail/go-mime v0.0.0-20230322103455-7d82a3887f2f // indirect
 	github.com/ProtonMail/gopenpgp/v2 v2.9.0 // indirect
-	github.com/aws/aws-sdk-go v1.55.7 // indirect
 	github.com/bramvdbogaerde/go-scp v1.5.0 // indirect
 	github.com/cloudflare/circl v1.6.1 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
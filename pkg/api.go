@@ -0,0 +1,590 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"github.com/spf13/cobra"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAPIListen = ":8080"
+	// maxAPIJobs is the number of jobs kept in memory
+	maxAPIJobs = 100
+	// maxAPIJobOutput bounds the output kept in memory for each job
+	maxAPIJobOutput = 1 << 20
+)
+
+// API job statuses
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// apiServer exposes the HTTP API, jobs run as child processes so a failing job never stops the server
+type apiServer struct {
+	listen    string
+	tokens    []string
+	scheduler *scheduler
+	jobs      *jobRegistry
+}
+
+// jobRequest is the body of a job creation request
+type jobRequest struct {
+	// Type is backup, restore or verify
+	Type string `json:"type"`
+	// Job is the name of a job of the configuration file
+	Job          string `json:"job"`
+	Database     string `json:"database"`
+	Storage      string `json:"storage"`
+	Path         string `json:"path"`
+	AllDatabases bool   `json:"allDatabases"`
+	File         string `json:"file"`
+	GlobalsFile  string `json:"globalsFile"`
+}
+
+// apiJob is a backup or restore triggered through the API
+type apiJob struct {
+	mu         sync.Mutex
+	id         string
+	kind       string
+	args       []string
+	status     string
+	startedAt  time.Time
+	finishedAt time.Time
+	err        string
+	// output holds the last bytes of the job output, written is the total number of bytes written
+	output  []byte
+	written int64
+}
+
+// apiJobStatus is the JSON representation of a job
+type apiJobStatus struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Args       []string   `json:"args"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// jobRegistry keeps the last jobs in memory
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs []*apiJob
+}
+
+// backupObject is a backup file stored on a storage
+type backupObject struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// StartServer starts the HTTP API without scheduler
+func StartServer(cmd *cobra.Command) {
+	intro()
+	listen := utils.GetEnv(cmd, "listen", "API_LISTEN")
+	if listen == "" {
+		listen = defaultAPIListen
+	}
+	newAPIServer(listen, nil).listenAndServe()
+}
+
+// newAPIServer creates the API server, the scheduler is nil when running without scheduled jobs
+func newAPIServer(listen string, sc *scheduler) *apiServer {
+	var tokens []string
+	for _, token := range strings.Split(utils.Env("API_TOKENS"), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		logger.Fatal("API_TOKENS is required to start the HTTP API")
+	}
+	return &apiServer{listen: listen, tokens: tokens, scheduler: sc, jobs: &jobRegistry{}}
+}
+
+// listenAndServe serves the API and exits on error
+func (s *apiServer) listenAndServe() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.Handle("POST /api/v1/jobs", s.auth(s.createJob))
+	mux.Handle("GET /api/v1/jobs", s.auth(s.listJobs))
+	mux.Handle("GET /api/v1/jobs/{id}", s.auth(s.getJob))
+	mux.Handle("GET /api/v1/jobs/{id}/logs", s.auth(s.jobLogs))
+	mux.Handle("GET /api/v1/backups", s.auth(s.listBackups))
+	mux.Handle("GET /api/v1/schedule", s.auth(s.schedule))
+	mux.Handle("GET /api/v1/history", s.auth(s.history))
+
+	server := &http.Server{
+		Addr:              s.listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Info("Starting HTTP API", "listen", s.listen)
+	if err := server.ListenAndServe(); err != nil {
+		logger.Fatal("Error starting HTTP API", "error", err)
+	}
+}
+
+// auth rejects requests without a valid bearer token
+func (s *apiServer) auth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !s.validToken(token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pg-bkup"`)
+			writeError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (s *apiServer) validToken(token string) bool {
+	valid := false
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func (s *apiServer) createJob(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	args, err := req.args()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	job, err := s.jobs.start(req.Type, args)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+func (s *apiServer) listJobs(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.jobs.list())
+}
+
+func (s *apiServer) getJob(w http.ResponseWriter, r *http.Request) {
+	job := s.jobs.get(r.PathValue("id"))
+	if job == nil {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
+
+// jobLogs writes the output of a job, and follows it until the job ends when follow=true
+func (s *apiServer) jobLogs(w http.ResponseWriter, r *http.Request) {
+	job := s.jobs.get(r.PathValue("id"))
+	if job == nil {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	follow := r.URL.Query().Get("follow") == "true"
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	var offset int64
+	for {
+		output, next, running := job.outputFrom(offset)
+		offset = next
+		if len(output) > 0 {
+			if _, err := w.Write(output); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if !follow || !running {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// listBackups lists the backup files of the local or S3 storage
+func (s *apiServer) listBackups(w http.ResponseWriter, r *http.Request) {
+	storage := StorageType(strings.ToLower(r.URL.Query().Get("storage")))
+	if storage == "" {
+		storage = StorageType(utils.EnvWithDefault("STORAGE", string(LocalStorage)))
+	}
+	if !canListBackups(storage) {
+		writeError(w, http.StatusNotImplemented, fmt.Sprintf("listing backups is not supported for %s storage", storage))
+		return
+	}
+	remotePath := r.URL.Query().Get("path")
+	if remotePath == "" && storage == S3Storage {
+		remotePath = os.Getenv("AWS_S3_PATH")
+	}
+	// Local listings are limited to the backup directory
+	if storage == LocalStorage {
+		remotePath = storagePath
+	}
+	backups, err := listBackups(r.Context(), storage, remotePath)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].LastModified.After(backups[j].LastModified) })
+	writeJSON(w, http.StatusOK, backups)
+}
+
+// schedule returns the next run times of the scheduled jobs
+func (s *apiServer) schedule(w http.ResponseWriter, _ *http.Request) {
+	if s.scheduler == nil {
+		writeJSON(w, http.StatusOK, []scheduleEntry{})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.scheduler.entries())
+}
+
+// history returns the backup runs of the run history, newest first
+func (s *apiServer) history(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since, err := parseSince(query.Get("since"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter := historyFilter{
+		job:      query.Get("job"),
+		database: query.Get("database"),
+		storage:  query.Get("storage"),
+		status:   query.Get("status"),
+		since:    since,
+		limit:    100,
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.limit, err = strconv.Atoi(limit)
+		if err != nil || filter.limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %q", limit))
+			return
+		}
+	}
+	records, err := readHistory(historyFile(), filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// args returns the command line of the job, flags use the --name=value form so values are never read as flags
+func (req jobRequest) args() ([]string, error) {
+	var args []string
+	switch req.Type {
+	case "backup":
+		args = []string{"backup"}
+		if req.Job != "" {
+			args = append(args, "--job="+req.Job)
+		} else if _, err := loadConfigFile(); err == nil {
+			return nil, errors.New("job is required when a configuration file is used")
+		}
+		if req.AllDatabases {
+			args = append(args, "--all-databases")
+		}
+	case "restore":
+		if req.File == "" {
+			return nil, errors.New("file is required for a restore job")
+		}
+		if req.Job != "" || req.AllDatabases {
+			return nil, errors.New("job and allDatabases are not supported for a restore job")
+		}
+		args = []string{"restore", "--file=" + req.File}
+		if req.GlobalsFile != "" {
+			args = append(args, "--globals-file="+req.GlobalsFile)
+		}
+	case "verify":
+		if req.File == "" {
+			return nil, errors.New("file is required for a verify job")
+		}
+		if req.Job != "" || req.AllDatabases || req.Database != "" || req.GlobalsFile != "" {
+			return nil, errors.New("job, database, allDatabases and globalsFile are not supported for a verify job")
+		}
+		args = []string{"verify", "--file=" + req.File}
+	default:
+		return nil, fmt.Errorf("unsupported job type %q, expected backup, restore or verify", req.Type)
+	}
+	if req.Database != "" {
+		args = append(args, "--dbname="+req.Database)
+	}
+	if req.Storage != "" {
+		args = append(args, "--storage="+req.Storage)
+	}
+	if req.Path != "" {
+		args = append(args, "--path="+req.Path)
+	}
+	return args, nil
+}
+
+// start runs a job in a child process
+func (reg *jobRegistry) start(kind string, args []string) (*apiJob, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate executable: %w", err)
+	}
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+	job := &apiJob{id: hex.EncodeToString(id), kind: kind, args: args, status: JobRunning, startedAt: time.Now()}
+	cmd := exec.Command(executable, args...)
+	cmd.Env = jobEnv()
+	cmd.Stdout = job
+	cmd.Stderr = job
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start job: %w", err)
+	}
+	reg.add(job)
+	logger.Info("API job started", "id", job.id, "type", kind, "args", strings.Join(args, " "))
+	go func() {
+		job.finish(cmd.Wait())
+		logger.Info("API job finished", "id", job.id, "type", kind, "status", job.snapshot().Status)
+	}()
+	return job, nil
+}
+
+// add registers a job and forgets the oldest finished jobs
+func (reg *jobRegistry) add(job *apiJob) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.jobs = append(reg.jobs, job)
+	for i := 0; len(reg.jobs) > maxAPIJobs && i < len(reg.jobs); {
+		if reg.jobs[i].snapshot().Status == JobRunning {
+			i++
+			continue
+		}
+		reg.jobs = append(reg.jobs[:i], reg.jobs[i+1:]...)
+	}
+}
+
+func (reg *jobRegistry) get(id string) *apiJob {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, job := range reg.jobs {
+		if job.id == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// list returns the jobs, most recent first
+func (reg *jobRegistry) list() []apiJobStatus {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	jobs := make([]apiJobStatus, 0, len(reg.jobs))
+	for i := len(reg.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, reg.jobs[i].snapshot())
+	}
+	return jobs
+}
+
+// Write appends the output of the child process, only the last maxAPIJobOutput bytes are kept
+func (j *apiJob) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.output = append(j.output, p...)
+	j.written += int64(len(p))
+	if len(j.output) > maxAPIJobOutput {
+		j.output = append([]byte(nil), j.output[len(j.output)-maxAPIJobOutput:]...)
+	}
+	return len(p), nil
+}
+
+// outputFrom returns the output written after offset, the offset of its end and whether the job is still running.
+// Output that is no longer kept is skipped.
+func (j *apiJob) outputFrom(offset int64) ([]byte, int64, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	start := int64(len(j.output)) - (j.written - offset)
+	if start < 0 {
+		start = 0
+	}
+	return append([]byte(nil), j.output[start:]...), j.written, j.status == JobRunning
+}
+
+func (j *apiJob) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finishedAt = time.Now()
+	j.status = JobSucceeded
+	if err != nil {
+		j.status = JobFailed
+		j.err = err.Error()
+	}
+}
+
+func (j *apiJob) snapshot() apiJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := apiJobStatus{
+		ID:        j.id,
+		Type:      j.kind,
+		Args:      j.args,
+		Status:    j.status,
+		StartedAt: j.startedAt,
+		Error:     j.err,
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		status.FinishedAt = &finishedAt
+	}
+	return status
+}
+
+// jobEnv returns the environment of the child processes, without the settings of the scheduled mode
+func jobEnv() []string {
+	var env []string
+	for _, e := range os.Environ() {
+		name, _, _ := strings.Cut(e, "=")
+		switch name {
+		case "BACKUP_CRON_EXPRESSION", "API_LISTEN", "METRICS_LISTEN":
+			continue
+		}
+		env = append(env, e)
+	}
+	return append(env, "BACKUP_TRIGGER="+triggerAPI)
+}
+
+// canListBackups reports whether the backup files of a storage can be listed
+func canListBackups(storage StorageType) bool {
+	return storage == LocalStorage || storage == S3Storage
+}
+
+// listBackups lists the backup files of the local or S3 storage
+func listBackups(ctx context.Context, storage StorageType, remotePath string) ([]backupObject, error) {
+	switch storage {
+	case LocalStorage:
+		return listLocalBackups(remotePath)
+	case S3Storage:
+		return listS3Backups(ctx, remotePath)
+	}
+	return nil, fmt.Errorf("listing backups is not supported for %s storage", storage)
+}
+
+// listLocalBackups lists the backup files of a directory of the local storage
+func listLocalBackups(dir string) ([]backupObject, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := []backupObject{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupObject{Name: entry.Name(), Size: info.Size(), LastModified: info.ModTime()})
+	}
+	return backups, nil
+}
+
+// listS3Backups lists the backup files stored in the S3 path
+func listS3Backups(ctx context.Context, remotePath string) ([]backupObject, error) {
+	if err := utils.CheckEnvVars(awsVars); err != nil {
+		return nil, err
+	}
+	client, err := newS3Client()
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimPrefix(remotePath, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	backups := []backupObject{}
+	err = client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(os.Getenv("AWS_S3_BUCKET_NAME")),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			backups = append(backups, backupObject{
+				Name:         path.Base(aws.StringValue(object.Key)),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	return backups, err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Error writing response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -42,12 +42,15 @@ func azureBackup(db *dbConfig, config *BackupConfig) {
 	// Backup database
 	err := BackupDatabase(db, config)
 	if err != nil {
-		recoverMode(err, "Error backing up database")
+		recoverMode(config, db.dbName, err, "Error backing up database")
 		return
 	}
 	finalFileName := config.backupFileName
 	if config.encryption {
-		encryptBackup(config)
+		if err := encryptBackup(config); err != nil {
+			recoverMode(config, db.dbName, err, "Error encrypting backup")
+			return
+		}
 		finalFileName = fmt.Sprintf("%s.%s", config.backupFileName, "gpg")
 	}
 	logger.Info("Uploading backup archive to Azure Blob storage ...", "filename", finalFileName)
@@ -57,52 +60,47 @@ func azureBackup(db *dbConfig, config *BackupConfig) {
 		AccountName:   azureConfig.accountName,
 		AccountKey:    azureConfig.accountKey,
 		RemotePath:    config.remotePath,
-		LocalPath:     tmpPath,
+		LocalPath:     config.run.workDir,
 	})
 	if err != nil {
-		logger.Fatal("Error creating Azure storage", "error", err)
+		recoverMode(config, db.dbName, err, "Error creating Azure storage")
+		return
 	}
 	err = azureStorage.Copy(finalFileName)
 	if err != nil {
-		logger.Fatal("Error copying backup file", "error", err)
+		recoverMode(config, db.dbName, err, "Error copying backup file")
+		return
 	}
 	logger.Info("Backup uploaded", "location", filepath.Join(config.remotePath, finalFileName))
 	// Get backup info
-	fileInfo, err := os.Stat(filepath.Join(tmpPath, finalFileName))
+	fileInfo, err := os.Stat(filepath.Join(config.run.workDir, finalFileName))
 	if err != nil {
 		logger.Error("Error getting backup info", "error", err)
 	}
-	backupSize = fileInfo.Size()
+	backupSize := fileInfo.Size()
+	config.run.checksum = fileChecksum(filepath.Join(config.run.workDir, finalFileName))
 	// Delete backup file from tmp folder
-	err = utils.DeleteFile(filepath.Join(tmpPath, finalFileName))
+	err = utils.DeleteFile(filepath.Join(config.run.workDir, finalFileName))
 	if err != nil {
 		logger.Error("Error deleting file", "error", err)
 
 	}
 	if config.prune {
-		err := azureStorage.Prune(config.backupRetention)
+		err := pruneBackups(azureStorage, config)
 		if err != nil {
-			logger.Fatal("Error deleting old backup", "storage", config.storage, "error", err)
+			logger.Error("Error deleting old backups, the backup has been completed", "storage", config.storage, "error", err)
 		}
 
 	}
 
-	duration := goutils.FormatDuration(time.Since(startTime), 0)
+	duration := goutils.FormatDuration(time.Since(config.run.startTime), 0)
 
 	logger.Info("Backup file uploaded to  Azure Blob storage", "file", finalFileName, "destination", storagePath)
 	logger.Info("Backup completed", "file", finalFileName, "size", goutils.ConvertBytes(uint64(backupSize)), "duration", duration)
 
+	config.run.completed(finalFileName, filepath.Join(config.remotePath, finalFileName), backupSize)
 	// Send notification
-	utils.NotifySuccess(&utils.NotificationData{
-		File:           finalFileName,
-		BackupSize:     goutils.ConvertBytes(uint64(backupSize)),
-		Database:       db.dbName,
-		Storage:        string(config.storage),
-		BackupLocation: filepath.Join(config.remotePath, finalFileName),
-		Duration:       duration,
-	})
-	// Delete temp
-	deleteTemp()
+	notifyBackupSucceeded(db, config, duration)
 	logger.Info(fmt.Sprintf("The backup of the %s database has been completed in %s", db.dbName, duration))
 }
 func azureRestore(db *dbConfig, conf *RestoreConfig) {
@@ -113,15 +111,21 @@ func azureRestore(db *dbConfig, conf *RestoreConfig) {
 		AccountName:   azureConfig.accountName,
 		AccountKey:    azureConfig.accountKey,
 		RemotePath:    conf.remotePath,
-		LocalPath:     tmpPath,
+		LocalPath:     conf.workDir,
 	})
 	if err != nil {
-		logger.Fatal("Error creating Azure Blob storage", "error", err)
+		failOperation("Error creating Azure Blob storage", "error", err)
 	}
 
 	err = azureStorage.CopyFrom(conf.file)
 	if err != nil {
-		logger.Fatal("Error downloading backup file", "error", err)
+		failOperation("Error downloading backup file", "error", err)
+	}
+	if conf.globalsFile != "" {
+		err = azureStorage.CopyFrom(conf.globalsFile)
+		if err != nil {
+			failOperation("Error downloading globals file", "error", err)
+		}
 	}
 	RestoreDatabase(db, conf)
 }
@@ -25,8 +25,8 @@
 package pkg
 
 import (
+	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5"
 	"github.com/jkaninda/encryptor"
@@ -34,7 +34,6 @@ import (
 	goutils "github.com/jkaninda/go-utils"
 	"github.com/jkaninda/logger"
 	"github.com/jkaninda/pg-bkup/utils"
-	"github.com/robfig/cron/v3"
 	"github.com/spf13/cobra"
 	"os"
 	"os/exec"
@@ -52,9 +51,12 @@ func StartBackup(cmd *cobra.Command) {
 	configFile, err := loadConfigFile()
 	if err != nil {
 		dbConf = initDbConfig(cmd)
+		if len(config.runJobs) > 0 {
+			logger.Fatal("The --job flag requires a configuration file")
+		}
 		if config.cronExpression == "" {
 			config.allowCustomName = true
-			createBackupTask(dbConf, config)
+			singleBackupTask(dbConf, config)
 		} else {
 			if utils.IsValidCronExpression(config.cronExpression) {
 				scheduledMode(dbConf, config)
@@ -71,7 +73,6 @@ func StartBackup(cmd *cobra.Command) {
 // scheduledMode Runs backup in scheduled mode
 func scheduledMode(db *dbConfig, config *BackupConfig) {
 	logger.Info("Running in Scheduled mode", "cron", config.cronExpression)
-	logger.Info(fmt.Sprintf("The next scheduled time is: %v", utils.CronNextTime(config.cronExpression).Format(timeFormat)))
 	logger.Info(fmt.Sprintf("Storage type %s ", config.storage))
 
 	// Test backup
@@ -83,71 +84,165 @@ func scheduledMode(db *dbConfig, config *BackupConfig) {
 	}
 	logger.Info("Testing backup configurations...done")
 	logger.Info("Creating backup task", "database", db.dbName, "storage", config.storage)
-	// Create a new cron instance
-	c := cron.New()
-
-	_, err = c.AddFunc(config.cronExpression, func() {
-		createBackupTask(db, config)
-		logger.Info("Backup task executed successfully; awaiting next scheduled time", "next_time", utils.CronNextTime(config.cronExpression).Format(timeFormat))
+	sc := newScheduler(utils.EnvWithDefault("BACKUP_STATE_FILE", defaultStateFile))
+	config.trigger = triggerSchedule
+	err = sc.add(singleJobName(db, config), config.cronExpression, initSchedule(), func() {
+		singleBackupTask(db, config)
 	})
 	if err != nil {
-		return
+		logger.Fatal("Error creating backup task", "error", err)
 	}
-	// Start the cron scheduler
-	c.Start()
 	logger.Info("Creating backup task...done")
-	logger.Info("Backup task started")
-	defer c.Stop()
-	select {}
+	startServers(config, sc)
+	if config.maxBackupAge > 0 {
+		wd := newWatchdog(config.maxBackupAge, sc.state)
+		watchDatabase(wd, singleJobName(db, config), db, config)
+		go wd.start()
+	}
+	sc.start()
 }
 
-// multiBackupTask backup multi database
-func multiBackupTask(databases []Database, bkConfig *BackupConfig) {
-	for _, db := range databases {
-		// Check if path is defined in config file
-		if db.Path != "" {
-			bkConfig.remotePath = db.Path
-		}
-		createBackupTask(getDatabase(db), bkConfig)
+// singleBackupTask backs up the database defined by flags and environment variables
+func singleBackupTask(db *dbConfig, config *BackupConfig) {
+	start := time.Now()
+	config.jobName = singleJobName(db, config)
+	config.slots = newSlots(config.concurrency)
+	metrics.runStarted(config.jobName)
+	config.heartbeat.started()
+	runs := createBackupTask(db, config)
+	if len(runs) > 1 {
+		logBackupSummary(config.jobName, runs, time.Since(start))
+	}
+	notifyDigest(config.jobName, runs, time.Since(start), config.recipients)
+	config.heartbeat.finished(runsReport(config.jobName, runs))
+	pushMetrics(config.jobName)
+	exitOnFailure(config.jobName, runs)
+}
+
+// singleJobName returns the job name of a backup defined by flags and environment variables
+func singleJobName(db *dbConfig, config *BackupConfig) string {
+	if config.all {
+		return "all_databases"
+	}
+	return db.dbName
+}
+
+// watchDatabase adds the database of a backup config to the watchdog,
+// databases of all-databases backups are added once they have been backed up
+func watchDatabase(wd *watchdog, job string, db *dbConfig, config *BackupConfig) {
+	if config.all && !config.allInOne {
+		return
+	}
+	wd.watch(job, db.dbName, config.recipients)
+}
+
+// startServers starts the HTTP API and the metrics server of the scheduled mode when enabled
+func startServers(config *BackupConfig, sc *scheduler) {
+	if config.apiListen != "" {
+		go newAPIServer(config.apiListen, sc).listenAndServe()
 	}
+	if config.metricsListen != "" {
+		go startMetricsServer(config.metricsListen, sc)
+	}
+}
+
+// multiBackupTask backup multi database
+func multiBackupTask(job backupJob, bkConfig *BackupConfig) {
+	concurrency := bkConfig.concurrency
+	if job.Concurrency > 0 {
+		concurrency = job.Concurrency
+	}
+	hb := bkConfig.heartbeat
+	if job.HeartbeatURL != "" {
+		hb = newHeartbeat(job.HeartbeatURL)
+	}
+	logger.Info("Starting backup job", "job", job.Name, "databases", len(job.databases), "concurrency", concurrency)
+	metrics.runStarted(job.Name)
+	hb.started()
+	start := time.Now()
+	// Roles and tablespaces are shared by the databases of an instance, they are dumped once per job
+	withGlobals := make([]bool, len(job.databases))
+	instances := map[string]bool{}
+	for i, db := range job.databases {
+		key := instanceKey(db)
+		withGlobals[i] = !instances[key]
+		instances[key] = true
+	}
+	// The databases share the slots of the job, including the databases of all-databases backups
+	slots := newSlots(concurrency)
+	results := make([][]*backupRun, len(job.databases))
+	runConcurrently(len(job.databases), func(i int) {
+		db := job.databases[i]
+		config := newJobBackupConfig(bkConfig, db, job.Job)
+		config.slots = slots
+		config.withGlobals = config.withGlobals && withGlobals[i]
+		results[i] = createBackupTask(getDatabase(db), config)
+	})
+	var runs []*backupRun
+	for _, result := range results {
+		runs = append(runs, result...)
+	}
+	logBackupSummary(job.Name, runs, time.Since(start))
+	notifyDigest(job.Name, runs, time.Since(start), bkConfig.recipients)
+	hb.finished(runsReport(job.Name, runs))
+	pushMetrics(job.Name)
+	exitOnFailure(job.Name, runs)
+	logger.Info("Backup job completed", "job", job.Name)
 }
 
-// createBackupTask backup task
-func createBackupTask(db *dbConfig, config *BackupConfig) {
+// createBackupTask backup task, returns the runs of the task
+func createBackupTask(db *dbConfig, config *BackupConfig) []*backupRun {
+	var runs []*backupRun
+	config.globals = nil
+	// pg_dumpall already includes roles and tablespaces in all-in-one mode
+	if config.withGlobals && !config.allInOne {
+		globals := backupGlobals(db, config)
+		runs = append(runs, globals)
+		if globals.err == nil {
+			config.globals = globals
+		}
+	}
 	if config.all && !config.allInOne {
-		backupAll(db, config)
+		runs = append(runs, backupAll(db, config)...)
 	} else {
 		if db.dbName == "" && !config.all {
 			logger.Fatal("Database name is required, use DB_NAME environment variable or -d flag")
 		}
-		backupTask(db, config)
+		runs = append(runs, backupTask(db, config))
 	}
+	return runs
 }
 
 // backupAll backup all databases
-func backupAll(db *dbConfig, config *BackupConfig) {
+func backupAll(db *dbConfig, config *BackupConfig) []*backupRun {
 	databases, err := listDatabases(*db)
 	if err != nil {
-		logger.Fatal("Error listing databases", "error", err)
-	}
-	logger.Info("Backing up all databases", "count", len(databases))
-	for _, dbName := range databases {
-		db.dbName = dbName
-		config.backupFileName = fmt.Sprintf("%s_%s.sql.gz", dbName, time.Now().Format("20060102_150405"))
-		backupTask(db, config)
-	}
-
+		run := &backupRun{job: config.jobName, database: "all_databases", storage: string(config.storage), startTime: time.Now(), logMark: utils.LogMark()}
+		config.run = run
+		recoverMode(config, db.dbName, err, "Error listing databases")
+		recordHistory(run, config)
+		return []*backupRun{run}
+	}
+	logger.Info("Backing up all databases", "count", len(databases), "concurrency", cap(config.slots))
+	runs := make([]*backupRun, len(databases))
+	runConcurrently(len(databases), func(i int) {
+		// Each database gets its own copy of the configs
+		database := *db
+		database.dbName = databases[i]
+		databaseConfig := *config
+		runs[i] = backupTask(&database, &databaseConfig)
+	})
+	return runs
 }
 
 // backupTask handles database backup tasks based on the provided configuration.
-func backupTask(db *dbConfig, config *BackupConfig) {
+func backupTask(db *dbConfig, config *BackupConfig) *backupRun {
 	logger.Info(
 		"Initiating backup task",
 		"database", db.dbName,
 		"storage", config.storage,
 		"compression", !config.disableCompression,
 	)
-	startTime = time.Now()
 	// Determine file name prefix
 	prefix := db.dbName
 	if config.all && config.allInOne {
@@ -158,7 +253,46 @@ func backupTask(db *dbConfig, config *BackupConfig) {
 	timestamp := time.Now().Format("20060102_150405")
 	config.backupFileName = generateBackupFileName(prefix, timestamp, config)
 
-	// Storage handler
+	return runBackup(db.dbName, db, config)
+}
+
+// backupGlobals backs up roles, grants and tablespaces next to the database dumps.
+// The dump is reported in the notifications of the databases, and pruned with them
+func backupGlobals(db *dbConfig, config *BackupConfig) *backupRun {
+	logger.Info("Initiating globals backup task", "host", db.dbHost, "storage", config.storage)
+	prefix := db.dbName
+	if config.all || prefix == "" {
+		prefix = "all_databases"
+	}
+	globalsConfig := *config
+	globalsConfig.globalsOnly = true
+	globalsConfig.prune = false
+	globalsConfig.backupFileName = generateBackupFileName(prefix, time.Now().Format("20060102_150405"), &globalsConfig)
+	return runBackup(prefix+"_globals", db, &globalsConfig)
+}
+
+// runBackup runs the storage backup in its own working directory, once a slot of the job is free
+func runBackup(name string, db *dbConfig, config *BackupConfig) *backupRun {
+	if config.slots != nil {
+		config.slots <- struct{}{}
+		defer func() { <-config.slots }()
+	}
+	run, err := newBackupRun(name)
+	run.storage = string(config.storage)
+	run.job = config.jobName
+	config.run = run
+	defer run.cleanup()
+	if err != nil {
+		recoverMode(config, db.dbName, err, "Error creating working directory")
+	} else {
+		storageBackup(db, config)
+	}
+	recordHistory(run, config)
+	return run
+}
+
+// storageBackup dispatches the backup to the configured storage
+func storageBackup(db *dbConfig, config *BackupConfig) {
 	switch config.storage {
 	case LocalStorage:
 		localBackup(db, config)
@@ -179,10 +313,16 @@ func backupTask(db *dbConfig, config *BackupConfig) {
 func generateBackupFileName(prefix, timestamp string, config *BackupConfig) string {
 	var name string
 	switch {
+	case config.globalsOnly:
+		name = fmt.Sprintf("%s_globals_%s", prefix, timestamp)
+
 	case config.schemaOnly:
 		config.disableCompression = true
 		name = fmt.Sprintf("%s_schema_%s", prefix, timestamp)
 
+	case len(config.subset) > 0:
+		name = fmt.Sprintf("%s_subset_%s", prefix, timestamp)
+
 	case len(config.tables) > 0:
 		config.disableCompression = true
 		name = fmt.Sprintf("%s_tables_%d_%s", prefix, len(config.tables), timestamp)
@@ -205,7 +345,7 @@ func generateBackupFileName(prefix, timestamp string, config *BackupConfig) stri
 // startMultiBackup start multi backup
 func startMultiBackup(bkConfig *BackupConfig, configFile string) {
 	logger.Info("Starting Multi backup task...")
-	conf, err := readConf(configFile)
+	conf, err := readConf(configFile, false)
 	if err != nil {
 		logger.Fatal("Error reading config file", "error", err)
 	}
@@ -216,78 +356,123 @@ func startMultiBackup(bkConfig *BackupConfig, configFile string) {
 	if len(conf.Databases) == 0 {
 		logger.Fatal("No databases found")
 	}
-	// Check if cronExpression is defined
-	if bkConfig.cronExpression == "" {
-		multiBackupTask(conf.Databases, bkConfig)
-	} else {
-		backupRescueMode = conf.BackupRescueMode
-		// Check if cronExpression is valid
-		if utils.IsValidCronExpression(bkConfig.cronExpression) {
-			logger.Info("Running in Scheduled mode", "cron", bkConfig.cronExpression)
-			logger.Info(fmt.Sprintf("The next scheduled time is: %v", utils.CronNextTime(bkConfig.cronExpression).Format(timeFormat)))
-			logger.Info(fmt.Sprintf("Storage type %s ", bkConfig.storage))
-
-			// Test backup
-			logger.Info("Testing backup configurations...")
-			for _, db := range conf.Databases {
-				err = testDatabaseConnection(getDatabase(db))
-				if err != nil {
-					recoverMode(err, fmt.Sprintf("Error connecting to database: %s", db.Name))
-					continue
-				}
-			}
-			logger.Info("Testing backup configurations...done")
-			logger.Info("Creating backup job...")
-			// Create a new cron instance
-			c := cron.New()
-
-			_, err := c.AddFunc(bkConfig.cronExpression, func() {
-				multiBackupTask(conf.Databases, bkConfig)
-				logger.Info("Next scheduled time", "time", utils.CronNextTime(bkConfig.cronExpression).Format(timeFormat))
+	backupRescueMode = conf.BackupRescueMode
+	if err := utils.SetNotifiers(notifierConfigs(conf)); err != nil {
+		logger.Fatal("Error reading notifications", "error", err)
+	}
+	if conf.Concurrency > 0 {
+		bkConfig.concurrency = conf.Concurrency
+	}
+	if conf.MaxBackupAge != "" {
+		bkConfig.maxBackupAge, err = parseMaxBackupAge(conf.MaxBackupAge)
+		if err != nil {
+			logger.Fatal("Error reading maxBackupAge", "error", err)
+		}
+	}
+	jobs, err := resolveJobs(conf, bkConfig.cronExpression)
+	if err != nil {
+		logger.Fatal("Error reading backup jobs", "error", err)
+	}
+	if len(bkConfig.runJobs) > 0 {
+		selected, err := selectJobs(jobs, bkConfig.runJobs)
+		if err != nil {
+			logger.Fatal("Error selecting backup jobs", "error", err)
+		}
+		for _, job := range selected {
+			multiBackupTask(job, bkConfig)
+		}
+		return
+	}
+	// Jobs without cron expression are executed immediately
+	var scheduled []backupJob
+	for _, job := range jobs {
+		if job.CronExpression == "" {
+			multiBackupTask(job, bkConfig)
+			continue
+		}
+		scheduled = append(scheduled, job)
+	}
+	if len(scheduled) == 0 {
+		return
+	}
+	logger.Info("Running in Scheduled mode", "jobs", len(scheduled))
 
-			})
+	// Test backup
+	logger.Info("Testing backup configurations...")
+	for _, job := range scheduled {
+		for _, db := range job.databases {
+			err = testDatabaseConnection(getDatabase(db))
 			if err != nil {
-				return
+				recoverMode(newJobBackupConfig(bkConfig, db, job.Job), db.Name, err, fmt.Sprintf("Error connecting to database: %s", db.Name))
+				continue
 			}
-			// Start the cron scheduler
-			c.Start()
-			logger.Info("Creating backup job...done")
-			logger.Info("Backup job started")
-			defer c.Stop()
-			select {}
-
-		} else {
-			logger.Fatal("Cron expression is not valid", "cron", bkConfig.cronExpression)
 		}
 	}
-
+	logger.Info("Testing backup configurations...done")
+	stateFile := utils.EnvWithDefault("BACKUP_STATE_FILE", defaultStateFile)
+	if conf.StateFile != "" {
+		stateFile = conf.StateFile
+	}
+	// All jobs share the same scheduler
+	sc := newScheduler(stateFile)
+	bkConfig.trigger = triggerSchedule
+	defaults := conf.Schedule.merge(initSchedule())
+	for _, job := range scheduled {
+		logger.Info("Creating backup job...", "job", job.Name, "cron", job.CronExpression, "databases", len(job.databases))
+		err := sc.add(job.Name, job.CronExpression, job.Schedule.merge(defaults), func() {
+			multiBackupTask(job, bkConfig)
+		})
+		if err != nil {
+			logger.Fatal("Error creating backup job", "job", job.Name, "error", err)
+		}
+	}
+	logger.Info("Creating backup job...done")
+	startServers(bkConfig, sc)
+	if bkConfig.maxBackupAge > 0 {
+		wd := newWatchdog(bkConfig.maxBackupAge, sc.state)
+		for _, job := range scheduled {
+			for _, db := range job.databases {
+				watchDatabase(wd, job.Name, getDatabase(db), newJobBackupConfig(bkConfig, db, job.Job))
+			}
+		}
+		go wd.start()
+	}
+	sc.start()
 }
 
 // BackupDatabase backs up the database, selected tables, or schema only.
 func BackupDatabase(db *dbConfig, config *BackupConfig) error {
-	storagePath = os.Getenv("STORAGE_PATH")
-
 	if err := testDatabaseConnection(db); err != nil {
 		return fmt.Errorf("database connection failed: %w", err)
 	}
+	if err := checkDiskSpace(db, config); err != nil {
+		return err
+	}
 
 	var (
 		dumpCmd  string
 		dumpArgs []string
 	)
 
-	dumpArgs = []string{
-		"-h", db.dbHost,
-		"-p", db.dbPort,
-		"-U", db.dbUserName,
+	passFile, removePassFile, err := createPassFile(db)
+	if err != nil {
+		return err
 	}
+	defer removePassFile()
+	dumpArgs = []string{"--dbname=" + db.clientConnString(passFile)}
 
-	if config.all && config.allInOne {
+	if config.globalsOnly {
+		logger.Info("Backing up roles, grants and tablespaces...")
+		dumpCmd = "pg_dumpall"
+		dumpArgs = append(dumpArgs, "--globals-only")
+		if config.noRolePasswords {
+			dumpArgs = append(dumpArgs, "--no-role-passwords")
+		}
+	} else if config.all && config.allInOne {
 		logger.Info("Backing up all databases...")
 		dumpCmd = "pg_dumpall"
 	} else {
 		dumpCmd = "pg_dump"
-		dumpArgs = append(dumpArgs, db.dbName)
 
 		if config.schemaOnly {
 			dumpArgs = append(dumpArgs, "--schema-only")
@@ -306,31 +491,66 @@ func BackupDatabase(db *dbConfig, config *BackupConfig) error {
 		} else if !config.schemaOnly && !config.dataOnly {
 			logger.Info(fmt.Sprintf("Backing up full database: %s", db.dbName))
 		}
+		for _, schema := range config.schemas {
+			dumpArgs = append(dumpArgs, "-n", schema)
+		}
+		for _, table := range config.excludeTables {
+			dumpArgs = append(dumpArgs, "--exclude-table", table)
+		}
+		for _, schema := range config.excludeSchemas {
+			dumpArgs = append(dumpArgs, "--exclude-schema", schema)
+		}
+		for _, table := range config.excludeTableData {
+			dumpArgs = append(dumpArgs, "--exclude-table-data", table)
+		}
+		if len(config.schemas) > 0 {
+			logger.Info(fmt.Sprintf("Backing up schemas: %v", config.schemas))
+		}
+		if len(config.excludeTables) > 0 || len(config.excludeSchemas) > 0 || len(config.excludeTableData) > 0 {
+			logger.Info("Excluding objects from backup", "tables", config.excludeTables, "schemas", config.excludeSchemas, "table_data", config.excludeTableData)
+		}
 	}
 
-	backupPath := filepath.Join(tmpPath, config.backupFileName)
+	backupPath := filepath.Join(config.run.workDir, config.backupFileName)
+
+	if len(config.subset) > 0 && !config.globalsOnly {
+		if dumpCmd != "pg_dump" {
+			return fmt.Errorf("subset is not supported for all-in-one backups")
+		}
+		return dumpSubset(db, config, dumpArgs, backupPath)
+	}
+	if config.masking != nil && !config.globalsOnly {
+		if dumpCmd != "pg_dump" {
+			return fmt.Errorf("masking profile is not supported for all-in-one backups")
+		}
+		if !config.schemaOnly {
+			return dumpWithMasking(db, config, dumpArgs, backupPath)
+		}
+	}
 
 	// Handle compression
 	if config.disableCompression {
-		return runCommandAndSaveOutput(dumpCmd, dumpArgs, backupPath)
+		return runCommandAndSaveOutput(dumpCmd, dumpArgs, backupPath, &config.run.stderr)
 	}
-	return runCommandWithCompression(dumpCmd, dumpArgs, backupPath)
+	return runCommandWithCompression(dumpCmd, dumpArgs, backupPath, &config.run.stderr)
 }
 
-// runCommandAndSaveOutput runs a command and saves the output to a file
-func runCommandAndSaveOutput(command string, args []string, outputPath string) error {
+// runCommandAndSaveOutput runs a command and saves the output to a file, the error output is written to stderr
+func runCommandAndSaveOutput(command string, args []string, outputPath string, stderr *bytes.Buffer) error {
 	cmd := exec.Command(command, args...)
-	output, err := cmd.CombinedOutput()
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("failed to execute %s: %v, output: %s", command, err, output)
+		return fmt.Errorf("failed to execute %s: %v, output: %s", command, err, stderr)
 	}
 
 	return os.WriteFile(outputPath, output, 0644)
 }
 
-// runCommandWithCompression runs a command and compresses the output
-func runCommandWithCompression(command string, args []string, outputPath string) error {
+// runCommandWithCompression runs a command and compresses the output, the error output is written to stderr
+func runCommandWithCompression(command string, args []string, outputPath string, stderr *bytes.Buffer) error {
 	cmd := exec.Command(command, args...)
+	cmd.Stderr = stderr
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("failed to create stdout pipe: %w", err)
@@ -354,7 +574,7 @@ func runCommandWithCompression(command string, args []string, outputPath string)
 		return fmt.Errorf("failed to start gzip: %w", err)
 	}
 	if err = cmd.Run(); err != nil {
-		return fmt.Errorf("failed to execute %s: %w", command, err)
+		return fmt.Errorf("failed to execute %s: %w, output: %s", command, err, stderr)
 	}
 	if err = gzipCmd.Wait(); err != nil {
 		return fmt.Errorf("failed to wait for gzip completion: %w", err)
@@ -369,71 +589,72 @@ func localBackup(db *dbConfig, config *BackupConfig) {
 	logger.Info("Backup database to local storage")
 	err := BackupDatabase(db, config)
 	if err != nil {
-		recoverMode(err, "Error backing up database")
+		recoverMode(config, db.dbName, err, "Error backing up database")
 		return
 	}
 	finalFileName := config.backupFileName
 	if config.encryption {
-		encryptBackup(config)
+		if err := encryptBackup(config); err != nil {
+			recoverMode(config, db.dbName, err, "Error encrypting backup")
+			return
+		}
 		finalFileName = fmt.Sprintf("%s.%s", config.backupFileName, gpgExtension)
 	}
-	fileInfo, err := os.Stat(filepath.Join(tmpPath, finalFileName))
+	fileInfo, err := os.Stat(filepath.Join(config.run.workDir, finalFileName))
 	if err != nil {
 		logger.Error("Error getting backup info", "error", err)
 	}
-	backupSize = fileInfo.Size()
+	backupSize := fileInfo.Size()
+	config.run.checksum = fileChecksum(filepath.Join(config.run.workDir, finalFileName))
+	if err := os.MkdirAll(config.localPath, 0755); err != nil {
+		recoverMode(config, db.dbName, err, "Error creating backup directory")
+		return
+	}
 	localStorage := local.NewStorage(local.Config{
-		LocalPath:  tmpPath,
-		RemotePath: storagePath,
+		LocalPath:  config.run.workDir,
+		RemotePath: config.localPath,
 	})
 	err = localStorage.Copy(finalFileName)
 	if err != nil {
-		logger.Fatal("Error copying backup file", "error", err)
+		recoverMode(config, db.dbName, err, "Error copying backup file")
+		return
 	}
 
-	duration := goutils.FormatDuration(time.Since(startTime), 0)
-	logger.Info("Backup file copied to local storage", "file", finalFileName, "destination", storagePath)
+	duration := goutils.FormatDuration(time.Since(config.run.startTime), 0)
+	logger.Info("Backup file copied to local storage", "file", finalFileName, "destination", config.localPath)
 	logger.Info("Backup completed", "file", finalFileName, "size", goutils.ConvertBytes(uint64(backupSize)), "duration", duration)
 
+	config.run.completed(finalFileName, filepath.Join(config.localPath, finalFileName), backupSize)
 	// Send notification
-	utils.NotifySuccess(&utils.NotificationData{
-		File:           finalFileName,
-		BackupSize:     goutils.ConvertBytes(uint64(backupSize)),
-		Database:       db.dbName,
-		Storage:        string(config.storage),
-		BackupLocation: filepath.Join(storagePath, finalFileName),
-		Duration:       duration,
-	})
+	notifyBackupSucceeded(db, config, duration)
 	// Delete old backup
 	if config.prune {
-		err = localStorage.Prune(config.backupRetention)
+		err = pruneBackups(localStorage, config)
 		if err != nil {
-			logger.Fatal(fmt.Sprintf("Error deleting old backup from %s storage: %s ", config.storage, err))
+			logger.Error("Error deleting old backups, the backup has been completed", "storage", config.storage, "error", err)
 		}
 
 	}
-	// Delete temp
-	deleteTemp()
 	logger.Info(fmt.Sprintf("The backup of the %s database has been completed in %s", db.dbName, duration))
 }
 
 // encryptBackup encrypt backup
-func encryptBackup(config *BackupConfig) {
+func encryptBackup(config *BackupConfig) error {
 	logger.Info("Starting backup encryption", "file", config.backupFileName)
-	backupFile, err := os.ReadFile(filepath.Join(tmpPath, config.backupFileName))
-	outputFile := fmt.Sprintf("%s.%s", filepath.Join(tmpPath, config.backupFileName), gpgExtension)
+	backupFile, err := os.ReadFile(filepath.Join(config.run.workDir, config.backupFileName))
+	outputFile := fmt.Sprintf("%s.%s", filepath.Join(config.run.workDir, config.backupFileName), gpgExtension)
 	if err != nil {
-		logger.Fatal("Error reading backup file", "error", err)
+		return fmt.Errorf("failed to read backup file: %w", err)
 	}
 	if config.usingKey {
 		logger.Info("Encrypting backup using public key...")
 		pubKey, err := os.ReadFile(config.publicKey)
 		if err != nil {
-			logger.Fatal("Error reading public key", "error", err)
+			return fmt.Errorf("failed to read public key: %w", err)
 		}
-		err = encryptor.EncryptWithPublicKey(backupFile, fmt.Sprintf("%s.%s", filepath.Join(tmpPath, config.backupFileName), gpgExtension), pubKey)
+		err = encryptor.EncryptWithPublicKey(backupFile, fmt.Sprintf("%s.%s", filepath.Join(config.run.workDir, config.backupFileName), gpgExtension), pubKey)
 		if err != nil {
-			logger.Fatal("Error encrypting backup file", "error", err)
+			return fmt.Errorf("failed to encrypt backup file: %w", err)
 		}
 		logger.Info("Encrypting backup using public key...done")
 
@@ -441,13 +662,13 @@ func encryptBackup(config *BackupConfig) {
 		logger.Info("Encrypting backup using passphrase...")
 		err := encryptor.Encrypt(backupFile, outputFile, config.passphrase)
 		if err != nil {
-			logger.Fatal("error during encrypting backup", "error", err)
+			return fmt.Errorf("failed to encrypt backup file: %w", err)
 		}
 		logger.Info("Encrypting backup using passphrase...done")
 
 	}
 	logger.Info("Encryption completed", "output", outputFile)
-
+	return nil
 }
 
 // listDatabases lists all databases in the PostgreSQL server
@@ -455,15 +676,9 @@ func listDatabases(db dbConfig) ([]string, error) {
 	databases := []string{}
 
 	logger.Info("Listing databases...")
-	// Create the PostgresSQL client config file
-	if err := createPGConfigFile(db); err != nil {
-		return databases, errors.New(err.Error())
-	}
-	// Construct the connection string
-	connString := fmt.Sprintf("postgres://%s:%s@%s:%s/postgres?sslmode=disable", db.dbUserName, db.dbPassword, db.dbHost, db.dbPort)
-
-	// Connect to the PostgreSQL server
-	conn, err := pgx.Connect(context.Background(), connString)
+	// Connect to the PostgreSQL server through the maintenance database
+	db.dbName = "postgres"
+	conn, err := pgx.Connect(context.Background(), db.connString())
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
 	}
@@ -505,17 +720,36 @@ func listDatabases(db dbConfig) ([]string, error) {
 	return databases, nil
 
 }
-func recoverMode(err error, msg string) {
-	if err != nil {
-		if backupRescueMode {
-			utils.NotifyError(fmt.Sprintf("%s : %v", msg, err))
-			logger.Error("Backup failed", "reason", msg, "error", err)
-			logger.Warn("Backup rescue mode is enabled,Backup will continue")
-		} else {
-			logger.Error("Backup failed", "reason", msg, "error", err)
-			logger.Fatal("An occurred error", "error", err)
-			return
-		}
-	}
 
+// recoverMode records and notifies the failure of the run, the job stops once its other backups have completed
+// unless rescue mode is enabled, see exitOnFailure. Failures outside of a run stop the process immediately.
+func recoverMode(config *BackupConfig, database string, err error, msg string) {
+	if err == nil {
+		return
+	}
+	event := &utils.Event{
+		Type:       utils.BackupFailed,
+		Database:   database,
+		Storage:    string(config.storage),
+		Error:      fmt.Sprintf("%s : %v", msg, err),
+		Recipients: config.recipients,
+	}
+	if config.run != nil {
+		config.run.err = fmt.Errorf("%s: %w", msg, err)
+		metrics.failed(backupOperation, config.run.metricKey())
+		event.Attachments = failureAttachments(config.run.stderr.String(), config.run.runLog())
+		// The failure is also summarized by the digest of the job
+		event.Job = config.jobName
+	}
+	utils.Notify(event)
+	logger.Error("Backup failed", "reason", msg, "error", err)
+	if backupRescueMode {
+		logger.Warn("Backup rescue mode is enabled,Backup will continue")
+		return
+	}
+	if config.run == nil {
+		config.heartbeat.finished(fmt.Sprintf("FAILED %s: %s: %v\n", database, msg, err), true)
+		pushMetrics(config.jobName)
+		logger.Fatal("An occurred error", "error", err)
+	}
 }
@@ -0,0 +1,173 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"sync"
+	"time"
+)
+
+// catalogTimeout limits the time spent writing a run to the catalog
+const catalogTimeout = 30 * time.Second
+
+// catalogMigrations create and upgrade the catalog schema, they are applied in order and must never be modified
+var catalogMigrations = []string{
+	`CREATE TABLE pgbkup.backup_runs (
+		id               bigserial PRIMARY KEY,
+		started_at       timestamptz NOT NULL,
+		finished_at      timestamptz NOT NULL DEFAULT now(),
+		job              text,
+		database         text NOT NULL,
+		storage          text NOT NULL,
+		file             text,
+		location         text,
+		size             bigint NOT NULL DEFAULT 0,
+		checksum         text,
+		duration_seconds double precision NOT NULL,
+		status           text NOT NULL CHECK (status IN ('success', 'failed')),
+		error            text,
+		trigger          text NOT NULL
+	);
+	CREATE INDEX backup_runs_database_idx ON pgbkup.backup_runs (database, started_at DESC)`,
+	`CREATE VIEW pgbkup.latest_backups AS
+	SELECT DISTINCT ON (database, storage) *
+	FROM pgbkup.backup_runs
+	WHERE status = 'success'
+	ORDER BY database, storage, started_at DESC`,
+}
+
+// catalog writes the backup runs to the pgbkup.backup_runs table of a catalog database
+type catalog struct {
+	db       *dbConfig
+	mu       sync.Mutex
+	migrated bool
+}
+
+// loadCatalog returns the catalog defined by CATALOG_DB_URL, or nil when the catalog is disabled
+func loadCatalog() (*catalog, error) {
+	uri := utils.Env("CATALOG_DB_URL")
+	if uri == "" {
+		return nil, nil
+	}
+	db, err := parseConnectionURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CATALOG_DB_URL: %w", err)
+	}
+	db.ssl = db.ssl.merge(loadSSLConfig("CATALOG_DB"))
+	if err := db.ssl.validate(); err != nil {
+		return nil, fmt.Errorf("invalid catalog TLS settings: %w", err)
+	}
+	return &catalog{db: db}, nil
+}
+
+// record inserts a backup run, errors are logged only
+func (c *catalog) record(record historyRecord) {
+	if c == nil {
+		return
+	}
+	if err := c.insert(record); err != nil {
+		logger.Error("Error writing backup run to the catalog", "database", c.db.dbName, "error", err)
+	}
+}
+
+func (c *catalog) insert(record historyRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), catalogTimeout)
+	defer cancel()
+	// The timeout covers the connection, an unreachable catalog must not hold the backup job
+	conn, err := pgx.Connect(ctx, c.db.connString())
+	if err != nil {
+		return fmt.Errorf("error connecting to the catalog database: %w", err)
+	}
+	defer func(conn *pgx.Conn) {
+		if err := conn.Close(context.Background()); err != nil {
+			logger.Error("Error closing connection", "error", err)
+		}
+	}(conn)
+	if err := c.migrate(ctx, conn); err != nil {
+		return err
+	}
+	_, err = conn.Exec(ctx, `INSERT INTO pgbkup.backup_runs
+		(started_at, job, database, storage, file, location, size, checksum, duration_seconds, status, error, trigger)
+		VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7, NULLIF($8, ''), $9, $10, NULLIF($11, ''), $12)`,
+		record.Time, record.Job, record.Database, record.Storage, record.File, record.Location,
+		record.Size, record.Checksum, record.Duration, record.Status, record.Error, record.Trigger)
+	if err != nil {
+		return fmt.Errorf("error inserting backup run: %w", err)
+	}
+	return nil
+}
+
+// migrate applies the missing migrations once per process,
+// an advisory lock serializes the instances sharing the catalog
+func (c *catalog) migrate(ctx context.Context, conn *pgx.Conn) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.migrated {
+		return nil
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error migrating the catalog: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	for _, stmt := range []string{
+		"SELECT pg_advisory_xact_lock(hashtext('pgbkup.schema_migrations'))",
+		"CREATE SCHEMA IF NOT EXISTS pgbkup",
+		`CREATE TABLE IF NOT EXISTS pgbkup.schema_migrations (
+			version    integer PRIMARY KEY,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`,
+	} {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("error migrating the catalog: %w", err)
+		}
+	}
+	var version int
+	if err := tx.QueryRow(ctx, "SELECT COALESCE(max(version), 0) FROM pgbkup.schema_migrations").Scan(&version); err != nil {
+		return fmt.Errorf("error reading the catalog version: %w", err)
+	}
+	if version > len(catalogMigrations) {
+		return fmt.Errorf("catalog version %d is newer than the version %d supported by this pg-bkup", version, len(catalogMigrations))
+	}
+	for i := version; i < len(catalogMigrations); i++ {
+		if _, err := tx.Exec(ctx, catalogMigrations[i]); err != nil {
+			return fmt.Errorf("error applying catalog migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO pgbkup.schema_migrations (version) VALUES ($1)", i+1); err != nil {
+			return fmt.Errorf("error applying catalog migration %d: %w", i+1, err)
+		}
+		logger.Info("Applied catalog migration", "version", i+1)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("error migrating the catalog: %w", err)
+	}
+	c.migrated = true
+	return nil
+}
@@ -26,57 +26,112 @@ package pkg
 
 import (
 	"fmt"
-	goutils "github.com/jkaninda/go-utils"
 	"github.com/jkaninda/logger"
 	"github.com/jkaninda/pg-bkup/utils"
 	"github.com/spf13/cobra"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func initDbConfig(cmd *cobra.Command) *dbConfig {
-	jdbcUri := os.Getenv("DB_URL")
-	if len(jdbcUri) != 0 {
-		config, err := convertJDBCToDbConfig(jdbcUri)
+	// Set env
+	utils.GetEnv(cmd, "dbname", "DB_NAME")
+	dbUrl := utils.Env("DB_URL")
+	if len(dbUrl) != 0 {
+		config, err := parseConnectionURI(dbUrl)
 		if err != nil {
-			logger.Fatal("Error converting JDBC to DB config", "error", err.Error())
+			logger.Fatal("Error parsing DB_URL", "error", err.Error())
+		}
+		if config.dbName == "" {
+			config.dbName = os.Getenv("DB_NAME")
+		}
+		config.ssl = config.ssl.merge(loadSSLConfig("DB"))
+		if err = config.ssl.validate(); err != nil {
+			logger.Fatal("Error checking database TLS settings", "error", err)
 		}
 		return config
 	}
-	// Set env
-	utils.GetEnv(cmd, "dbname", "DB_NAME")
 	dConf := dbConfig{}
+	dConf.service = utils.EnvWithDefault("DB_SERVICE", os.Getenv("PGSERVICE"))
 	dConf.dbHost = os.Getenv("DB_HOST")
-	dConf.dbPort = utils.EnvWithDefault("DB_PORT", defaultDbPort)
+	dConf.dbPort = os.Getenv("DB_PORT")
+	if dConf.dbPort == "" && dConf.service == "" {
+		dConf.dbPort = defaultDbPort
+	}
 	dConf.dbName = os.Getenv("DB_NAME")
-	dConf.dbUserName = os.Getenv("DB_USERNAME")
-	dConf.dbPassword = os.Getenv("DB_PASSWORD")
+	dConf.dbUserName = utils.Env("DB_USERNAME")
+	dConf.dbPassword = utils.Env("DB_PASSWORD")
+	dConf.ssl = loadSSLConfig("DB")
 
-	err := utils.CheckEnvVars(dbHVars)
-	if err != nil {
-		logger.Error("Please make sure all required environment variables for database are set")
-		logger.Fatal("Error checking environment variables", "error", err)
+	// Connection settings are read from the service file when a service is defined
+	if dConf.service == "" {
+		err := utils.CheckEnvVars(dbHVars)
+		if err != nil {
+			logger.Error("Please make sure all required environment variables for database are set")
+			logger.Fatal("Error checking environment variables", "error", err)
+		}
+	}
+	if err := dConf.ssl.validate(); err != nil {
+		logger.Fatal("Error checking database TLS settings", "error", err)
 	}
 	return &dConf
 }
 
 func getDatabase(database Database) *dbConfig {
 	// Set default values from environment variables if not provided
-	database.Name = goutils.ReplaceEnvVars(database.Name)
-	database.User = goutils.ReplaceEnvVars(getEnvOrDefault(database.User, "DB_USERNAME", database.Name, ""))
-	database.Password = goutils.ReplaceEnvVars(getEnvOrDefault(database.Password, "DB_PASSWORD", database.Name, ""))
-	database.Host = goutils.ReplaceEnvVars(getEnvOrDefault(database.Host, "DB_HOST", database.Name, ""))
-	database.Port = goutils.ReplaceEnvVars(getEnvOrDefault(database.Port, "DB_PORT", database.Name, defaultDbPort))
+	database.Name = utils.ReplaceEnvVars(database.Name)
+	database.User = utils.ReplaceEnvVars(getEnvOrDefault(database.User, "DB_USERNAME", database.Name, ""))
+	database.Password = utils.ReplaceEnvVars(getEnvOrDefault(database.Password, "DB_PASSWORD", database.Name, ""))
+	password, err := readSecret(database.Password)
+	if err != nil {
+		logger.Fatal("Error reading database password", "database", database.Name, "error", err)
+	}
+	database.Password = password
+	database.Host = utils.ReplaceEnvVars(getEnvOrDefault(database.Host, "DB_HOST", database.Name, ""))
+	database.Service = utils.ReplaceEnvVars(getEnvOrDefault(database.Service, "DB_SERVICE", database.Name, ""))
+	defaultPort := defaultDbPort
+	if database.Service != "" {
+		defaultPort = ""
+	}
+	database.Port = utils.ReplaceEnvVars(getEnvOrDefault(database.Port, "DB_PORT", database.Name, defaultPort))
 	return &dbConfig{
 		dbHost:     database.Host,
 		dbPort:     database.Port,
 		dbName:     database.Name,
 		dbUserName: database.User,
 		dbPassword: database.Password,
+		service:    database.Service,
+		ssl: sslConfig{
+			mode:     utils.ReplaceEnvVars(getEnvOrDefault(database.SSLMode, "DB_SSLMODE", database.Name, "")),
+			rootCert: utils.ReplaceEnvVars(getEnvOrDefault(database.SSLRootCert, "DB_SSLROOTCERT", database.Name, "")),
+			cert:     utils.ReplaceEnvVars(getEnvOrDefault(database.SSLCert, "DB_SSLCERT", database.Name, "")),
+			key:      utils.ReplaceEnvVars(getEnvOrDefault(database.SSLKey, "DB_SSLKEY", database.Name, "")),
+		},
 	}
 }
 
+// loadSSLConfig loads the TLS settings from environment variables with the given prefix, e.g. DB or TARGET_DB
+func loadSSLConfig(prefix string) sslConfig {
+	return sslConfig{
+		mode:     os.Getenv(prefix + "_SSLMODE"),
+		rootCert: os.Getenv(prefix + "_SSLROOTCERT"),
+		cert:     os.Getenv(prefix + "_SSLCERT"),
+		key:      os.Getenv(prefix + "_SSLKEY"),
+	}
+}
+
+// readSecret returns the content of the file referenced by a "file:" value, e.g. file:/run/secrets/db_password
+func readSecret(value string) (string, error) {
+	path, ok := strings.CutPrefix(value, "file:")
+	if !ok {
+		return value, nil
+	}
+	return utils.ReadSecretFile(path)
+}
+
 // Helper function to get environment variable or use a default value
 func getEnvOrDefault(currentValue, envKey, suffix, defaultValue string) string {
 	// Return the current value if it's already set
@@ -87,12 +142,12 @@ func getEnvOrDefault(currentValue, envKey, suffix, defaultValue string) string {
 	// Check for suffixed or prefixed environment variables if a suffix is provided
 	if suffix != "" {
 		suffixUpper := strings.ToUpper(suffix)
-		envSuffix := os.Getenv(fmt.Sprintf("%s_%s", envKey, suffixUpper))
+		envSuffix := utils.Env(fmt.Sprintf("%s_%s", envKey, suffixUpper))
 		if envSuffix != "" {
 			return envSuffix
 		}
 
-		envPrefix := os.Getenv(fmt.Sprintf("%s_%s", suffixUpper, envKey))
+		envPrefix := utils.Env(fmt.Sprintf("%s_%s", suffixUpper, envKey))
 		if envPrefix != "" {
 			return envPrefix
 		}
@@ -113,7 +168,7 @@ func loadSSHConfig() (*SSHConfig, error) {
 
 	return &SSHConfig{
 		user:         os.Getenv("SSH_USER"),
-		password:     os.Getenv("SSH_PASSWORD"),
+		password:     utils.Env("SSH_PASSWORD"),
 		hostName:     os.Getenv("SSH_HOST"),
 		port:         utils.GetIntEnv("SSH_PORT"),
 		identifyFile: os.Getenv("SSH_IDENTIFY_FILE"),
@@ -124,7 +179,7 @@ func loadFtpConfig() *FTPConfig {
 	fConfig := FTPConfig{}
 	fConfig.host = utils.GetEnvVariable("FTP_HOST", "FTP_HOST_NAME")
 	fConfig.user = os.Getenv("FTP_USER")
-	fConfig.password = os.Getenv("FTP_PASSWORD")
+	fConfig.password = utils.Env("FTP_PASSWORD")
 	fConfig.port = utils.GetIntEnv("FTP_PORT")
 	fConfig.remotePath = os.Getenv("REMOTE_PATH")
 	err := utils.CheckEnvVars(ftpVars)
@@ -139,7 +194,7 @@ func loadAzureConfig() *AzureConfig {
 	aConfig := AzureConfig{}
 	aConfig.containerName = os.Getenv("AZURE_STORAGE_CONTAINER_NAME")
 	aConfig.accountName = os.Getenv("AZURE_STORAGE_ACCOUNT_NAME")
-	aConfig.accountKey = os.Getenv("AZURE_STORAGE_ACCOUNT_KEY")
+	aConfig.accountKey = utils.Env("AZURE_STORAGE_ACCOUNT_KEY")
 
 	err := utils.CheckEnvVars(azureVars)
 	if err != nil {
@@ -198,9 +253,35 @@ func initBackupConfig(cmd *cobra.Command) *BackupConfig {
 	schemaOnly, _ := cmd.Flags().GetBool("schema-only")
 	dataOnly, _ := cmd.Flags().GetBool("data-only")
 	tables, _ := cmd.Flags().GetStringSlice("tables")
+	schemas, _ := cmd.Flags().GetStringSlice("schemas")
+	excludeTables, _ := cmd.Flags().GetStringSlice("exclude-table")
+	excludeSchemas, _ := cmd.Flags().GetStringSlice("exclude-schema")
+	excludeTableData, _ := cmd.Flags().GetStringSlice("exclude-table-data")
+	subset, _ := cmd.Flags().GetStringArray("subset")
+	withGlobals, _ := cmd.Flags().GetBool("with-globals")
+	masking := initMaskingProfile(utils.GetEnv(cmd, "masking-profile", "MASKING_PROFILE"))
+	noRolePasswords, _ := cmd.Flags().GetBool("no-role-passwords")
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	if concurrency == 0 {
+		concurrency = utils.GetIntEnv("BACKUP_CONCURRENCY")
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	runJobs, _ := cmd.Flags().GetStringSlice("job")
+	apiListen := utils.GetEnv(cmd, "api-listen", "API_LISTEN")
+	metricsListen := utils.GetEnv(cmd, "metrics-listen", "METRICS_LISTEN")
+	maxBackupAge, err := parseMaxBackupAge(os.Getenv("BACKUP_MAX_AGE"))
+	if err != nil {
+		logger.Fatal("Error reading BACKUP_MAX_AGE", "error", err)
+	}
+	catalog, err := loadCatalog()
+	if err != nil {
+		logger.Fatal("Error reading the catalog settings", "error", err)
+	}
 
 	_, _ = cmd.Flags().GetString("mode")
-	passphrase := os.Getenv("GPG_PASSPHRASE")
+	passphrase := utils.Env("GPG_PASSPHRASE")
 	_ = utils.GetEnv(cmd, "path", "AWS_S3_PATH")
 	cronExpression := os.Getenv("BACKUP_CRON_EXPRESSION")
 
@@ -222,6 +303,7 @@ func initBackupConfig(cmd *cobra.Command) *BackupConfig {
 	config.storage = StorageType(storage)
 	config.encryption = encryption
 	config.remotePath = remotePath
+	config.localPath = storagePath
 	config.passphrase = passphrase
 	config.publicKey = publicKeyFile
 	config.usingKey = usingKey
@@ -232,18 +314,206 @@ func initBackupConfig(cmd *cobra.Command) *BackupConfig {
 	config.schemaOnly = schemaOnly
 	config.dataOnly = dataOnly
 	config.tables = tables
+	config.schemas = schemas
+	config.excludeTables = excludeTables
+	config.excludeSchemas = excludeSchemas
+	config.excludeTableData = excludeTableData
+	config.subset = subset
+	config.withGlobals = withGlobals
+	config.noRolePasswords = noRolePasswords
+	config.masking = masking
+	config.concurrency = concurrency
+	config.runJobs = runJobs
+	config.apiListen = apiListen
+	config.metricsListen = metricsListen
+	config.heartbeat = loadHeartbeat()
+	config.trigger = utils.EnvWithDefault("BACKUP_TRIGGER", triggerManual)
+	config.maxBackupAge = maxBackupAge
+	config.catalog = catalog
+	return &config
+}
+
+// notifierConfigs returns the notifications block with environment variables replaced
+func notifierConfigs(conf *Config) []utils.NotifierConfig {
+	configs := make([]utils.NotifierConfig, len(conf.Notifications))
+	for i, n := range conf.Notifications {
+		n.URL = utils.ReplaceEnvVars(n.URL)
+		n.Secret = utils.ReplaceEnvVars(n.Secret)
+		n.To = utils.ReplaceEnvVars(n.To)
+		n.ChatID = utils.ReplaceEnvVars(n.ChatID)
+		n.RoutingKey = utils.ReplaceEnvVars(n.RoutingKey)
+		n.APIKey = utils.ReplaceEnvVars(n.APIKey)
+		headers := make(map[string]string, len(n.Headers))
+		for key, value := range n.Headers {
+			headers[key] = utils.ReplaceEnvVars(value)
+		}
+		n.Headers = headers
+		configs[i] = n
+	}
+	return configs
+}
+
+// parseMaxBackupAge parses the maximum age of the backups, e.g. 26h
+func parseMaxBackupAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	maxAge, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid maximum backup age %q: %w", value, err)
+	}
+	if maxAge <= 0 {
+		return 0, fmt.Errorf("maximum backup age %q must be positive", value)
+	}
+	return maxAge, nil
+}
+
+// localStoragePath returns the directory of the local storage for a path, relative paths are in the backup directory
+func localStoragePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(storagePath, path)
+}
+
+// newDatabaseBackupConfig returns a copy of the global backup config with the database overrides applied
+func newDatabaseBackupConfig(bkConfig *BackupConfig, db Database) *BackupConfig {
+	config := *bkConfig
+	// Check if path is defined in config file
+	if db.Path != "" {
+		config.remotePath = db.Path
+		config.localPath = localStoragePath(db.Path)
+	}
+	if db.Storage != "" {
+		config.storage = StorageType(strings.ToLower(db.Storage))
+	}
+	if db.BackupRetentionDays != nil {
+		config.backupRetention = *db.BackupRetentionDays
+		config.prune = config.backupRetention > 0
+	}
+	if db.DisableCompression != nil {
+		config.disableCompression = *db.DisableCompression
+	}
+	if db.SchemaOnly {
+		config.schemaOnly = true
+	}
+	if db.DataOnly {
+		config.dataOnly = true
+	}
+	if db.GpgPublicKey != "" {
+		config.encryption = true
+		config.usingKey = true
+		config.publicKey = utils.ReplaceEnvVars(db.GpgPublicKey)
+	} else if db.GpgPassphrase != "" {
+		passphrase, err := readSecret(utils.ReplaceEnvVars(db.GpgPassphrase))
+		if err != nil {
+			logger.Fatal("Error reading GPG passphrase", "database", db.Name, "error", err)
+		}
+		config.encryption = true
+		config.usingKey = false
+		config.passphrase = passphrase
+	}
+	if len(db.Tables) > 0 {
+		config.tables = db.Tables
+	}
+	if len(db.Schemas) > 0 {
+		config.schemas = db.Schemas
+	}
+	if len(db.ExcludeTables) > 0 {
+		config.excludeTables = db.ExcludeTables
+	}
+	if len(db.ExcludeSchemas) > 0 {
+		config.excludeSchemas = db.ExcludeSchemas
+	}
+	if len(db.ExcludeTableData) > 0 {
+		config.excludeTableData = db.ExcludeTableData
+	}
+	if len(db.Subset) > 0 {
+		config.subset = db.Subset
+	}
+	if db.Notification != nil {
+		config.recipients = &utils.Recipients{
+			MailTo:         utils.ReplaceEnvVars(db.Notification.MailTo),
+			MailCc:         utils.ReplaceEnvVars(db.Notification.MailCc),
+			MailBcc:        utils.ReplaceEnvVars(db.Notification.MailBcc),
+			TelegramChatId: utils.ReplaceEnvVars(db.Notification.TelegramChatId),
+		}
+	}
 	return &config
 }
 
+// newJobBackupConfig returns the backup config of a database within a job,
+// database settings override job settings, which override the global settings
+func newJobBackupConfig(bkConfig *BackupConfig, db Database, job Job) *BackupConfig {
+	config := newDatabaseBackupConfig(bkConfig, db)
+	config.jobName = job.Name
+	if job.CronExpression != "" {
+		config.cronExpression = job.CronExpression
+	}
+	if job.HeartbeatURL != "" {
+		config.heartbeat = newHeartbeat(job.HeartbeatURL)
+	}
+	if job.Storage != "" && db.Storage == "" {
+		config.storage = StorageType(strings.ToLower(job.Storage))
+	}
+	if job.Path != "" && db.Path == "" {
+		config.remotePath = job.Path
+		config.localPath = localStoragePath(job.Path)
+	}
+	if job.BackupRetentionDays != nil && db.BackupRetentionDays == nil {
+		config.backupRetention = *job.BackupRetentionDays
+		config.prune = config.backupRetention > 0
+	}
+	if job.Concurrency > 0 {
+		config.concurrency = job.Concurrency
+	}
+	// schemaOnly and dataOnly of the database win over the type of the job
+	dbType := db.SchemaOnly || db.DataOnly
+	switch job.Type {
+	case FullBackup:
+		if !dbType {
+			config.schemaOnly = false
+			config.dataOnly = false
+		}
+	case SchemaOnlyBackup:
+		if !dbType {
+			config.schemaOnly = true
+			config.dataOnly = false
+		}
+	case DataOnlyBackup:
+		if !dbType {
+			config.schemaOnly = false
+			config.dataOnly = true
+		}
+	case AllDatabasesBackup:
+		config.all = true
+		config.allInOne = false
+	case AllInOneBackup:
+		config.all = true
+		config.allInOne = true
+	}
+	return config
+}
+
 type RestoreConfig struct {
-	s3Path     string
-	remotePath string
-	storage    StorageType
-	file       string
-	bucket     string
-	usingKey   bool
-	passphrase string
-	privateKey string
+	s3Path      string
+	remotePath  string
+	storage     StorageType
+	file        string
+	bucket      string
+	usingKey    bool
+	passphrase  string
+	privateKey  string
+	globalsFile string
+	// workDir is the working directory of the restore
+	workDir string
+	// rows is the number of rows restored
+	rows int64
+	// verifyOnly checks the backup file instead of restoring it
+	verifyOnly bool
+	// size and checksum are those of the verified file
+	size     int64
+	checksum string
 }
 
 func initRestoreConfig(cmd *cobra.Command) *RestoreConfig {
@@ -255,8 +525,9 @@ func initRestoreConfig(cmd *cobra.Command) *RestoreConfig {
 	remotePath := utils.GetEnvVariable("REMOTE_PATH", "SSH_REMOTE_PATH")
 	storage = utils.GetEnv(cmd, "storage", "STORAGE")
 	file = utils.GetEnv(cmd, "file", "FILE_NAME")
+	globalsFile := utils.GetEnv(cmd, "globals-file", "GLOBALS_FILE_NAME")
 	bucket := utils.GetEnvVariable("AWS_S3_BUCKET_NAME", "BUCKET_NAME")
-	passphrase := os.Getenv("GPG_PASSPHRASE")
+	passphrase := utils.Env("GPG_PASSPHRASE")
 	privateKeyFile, err := checkPrKeyFile(os.Getenv("GPG_PRIVATE_KEY"))
 	if err == nil {
 		usingKey = true
@@ -274,14 +545,19 @@ func initRestoreConfig(cmd *cobra.Command) *RestoreConfig {
 	rConfig.passphrase = passphrase
 	rConfig.usingKey = usingKey
 	rConfig.privateKey = privateKeyFile
+	rConfig.globalsFile = globalsFile
 	return &rConfig
 }
 func initTargetDbConfig() *targetDbConfig {
-	jdbcUri := os.Getenv("TARGET_DB_URL")
-	if len(jdbcUri) != 0 {
-		config, err := convertJDBCToDbConfig(jdbcUri)
+	dbUrl := utils.Env("TARGET_DB_URL")
+	if len(dbUrl) != 0 {
+		config, err := parseConnectionURI(dbUrl)
 		if err != nil {
-			logger.Fatal("Error", "error", err.Error())
+			logger.Fatal("Error parsing TARGET_DB_URL", "error", err.Error())
+		}
+		ssl := config.ssl.merge(loadSSLConfig("TARGET_DB"))
+		if err = ssl.validate(); err != nil {
+			logger.Fatal("Error checking target database TLS settings", "error", err)
 		}
 		return &targetDbConfig{
 			targetDbHost:     config.dbHost,
@@ -289,19 +565,32 @@ func initTargetDbConfig() *targetDbConfig {
 			targetDbName:     config.dbName,
 			targetDbPassword: config.dbPassword,
 			targetDbUserName: config.dbUserName,
+			targetDbService:  config.service,
+			targetDbSsl:      ssl,
+			targetDbParams:   config.params,
 		}
 	}
 	tdbConfig := targetDbConfig{}
+	tdbConfig.targetDbService = os.Getenv("TARGET_DB_SERVICE")
 	tdbConfig.targetDbHost = os.Getenv("TARGET_DB_HOST")
-	tdbConfig.targetDbPort = utils.EnvWithDefault("TARGET_DB_PORT", defaultDbPort)
+	tdbConfig.targetDbPort = os.Getenv("TARGET_DB_PORT")
+	if tdbConfig.targetDbPort == "" && tdbConfig.targetDbService == "" {
+		tdbConfig.targetDbPort = defaultDbPort
+	}
 	tdbConfig.targetDbName = os.Getenv("TARGET_DB_NAME")
-	tdbConfig.targetDbUserName = os.Getenv("TARGET_DB_USERNAME")
-	tdbConfig.targetDbPassword = os.Getenv("TARGET_DB_PASSWORD")
+	tdbConfig.targetDbUserName = utils.Env("TARGET_DB_USERNAME")
+	tdbConfig.targetDbPassword = utils.Env("TARGET_DB_PASSWORD")
+	tdbConfig.targetDbSsl = loadSSLConfig("TARGET_DB")
 
-	err := utils.CheckEnvVars(tdbRVars)
-	if err != nil {
-		logger.Error("Please make sure all required environment variables for the target database are set")
-		logger.Fatal("Error checking target database environment variables", "error", err)
+	if tdbConfig.targetDbService == "" {
+		err := utils.CheckEnvVars(tdbRVars)
+		if err != nil {
+			logger.Error("Please make sure all required environment variables for the target database are set")
+			logger.Fatal("Error checking target database environment variables", "error", err)
+		}
+	}
+	if err := tdbConfig.targetDbSsl.validate(); err != nil {
+		logger.Fatal("Error checking target database TLS settings", "error", err)
 	}
 	return &tdbConfig
 }
@@ -0,0 +1,113 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"github.com/jackc/pgx/v5"
+	"testing"
+)
+
+func TestParseConnectionURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    dbConfig
+		wantErr bool
+	}{
+		{"simple", "postgres://bob:secret@db:5433/shop",
+			dbConfig{dbHost: "db", dbPort: "5433", dbName: "shop", dbUserName: "bob", dbPassword: "secret"}, false},
+		{"default port", "postgresql://bob@db/shop",
+			dbConfig{dbHost: "db", dbPort: defaultDbPort, dbName: "shop", dbUserName: "bob"}, false},
+		{"encoded password", "postgres://bob:p%40ss%3Aw%2Fd@db/shop",
+			dbConfig{dbHost: "db", dbPort: defaultDbPort, dbName: "shop", dbUserName: "bob", dbPassword: "p@ss:w/d"}, false},
+		{"multiple hosts", "postgres://bob@db1:5432,db2:5433/shop",
+			dbConfig{dbHost: "db1,db2", dbPort: "5432,5433", dbName: "shop", dbUserName: "bob"}, false},
+		{"ipv6 host", "postgres://bob@[::1]:5432/shop",
+			dbConfig{dbHost: "::1", dbPort: "5432", dbName: "shop", dbUserName: "bob"}, false},
+		{"jdbc parameters", "jdbc:postgresql://db:5432/shop?user=bob&password=secret&sslmode=require",
+			dbConfig{dbHost: "db", dbPort: "5432", dbName: "shop", dbUserName: "bob", dbPassword: "secret", ssl: sslConfig{mode: "require"}}, false},
+		{"extra parameters", "postgres://bob@db/shop?application_name=pg-bkup",
+			dbConfig{dbHost: "db", dbPort: defaultDbPort, dbName: "shop", dbUserName: "bob", params: map[string]string{"application_name": "pg-bkup"}}, false},
+		{"service", "postgres:///shop?service=prod",
+			dbConfig{dbName: "shop", service: "prod"}, false},
+		{"unsupported scheme", "mysql://bob@db/shop", dbConfig{}, true},
+		{"missing username", "postgres://db/shop", dbConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConnectionURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConnectionURI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.dbHost != tt.want.dbHost || got.dbPort != tt.want.dbPort || got.dbName != tt.want.dbName ||
+				got.dbUserName != tt.want.dbUserName || got.dbPassword != tt.want.dbPassword ||
+				got.service != tt.want.service || got.ssl != tt.want.ssl || len(got.params) != len(tt.want.params) {
+				t.Fatalf("parseConnectionURI() = %+v, want %+v", *got, tt.want)
+			}
+			for key, value := range tt.want.params {
+				if got.params[key] != value {
+					t.Errorf("parameter %s = %q, want %q", key, got.params[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestConnStringQuoting(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		quoted   string
+	}{
+		{"plain", "secret", `'secret'`},
+		{"space", "my secret", `'my secret'`},
+		{"single quote", "it's", `'it\'s'`},
+		{"backslash", `back\slash`, `'back\\slash'`},
+		{"equal sign", "a=b", `'a=b'`},
+		{"empty", "", `''`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quoteConnValue(tt.password); got != tt.quoted {
+				t.Errorf("quoteConnValue() = %s, want %s", got, tt.quoted)
+			}
+			if tt.password == "" {
+				return
+			}
+			// The connection string must give back the same value to the driver
+			db := &dbConfig{dbHost: "db", dbPort: "5432", dbName: "shop", dbUserName: "bob", dbPassword: tt.password}
+			config, err := pgx.ParseConfig(db.connString())
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			if config.Password != tt.password {
+				t.Errorf("password = %q, want %q", config.Password, tt.password)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	goutils "github.com/jkaninda/go-utils"
+	"github.com/jkaninda/logger"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// checkDiskSpace fails early when the working directory cannot hold the dump,
+// the size of the dumped tables is used as an estimate of the dump size
+func checkDiskSpace(db *dbConfig, config *BackupConfig) error {
+	if enabled, err := strconv.ParseBool(os.Getenv("BACKUP_DISK_CHECK")); err == nil && !enabled {
+		return nil
+	}
+	if config.globalsOnly || config.schemaOnly {
+		return nil
+	}
+	estimated, err := estimateDumpSize(db, config)
+	if err != nil {
+		logger.Warn("Could not estimate the backup size, skipping disk space check", "error", err)
+		return nil
+	}
+	available, err := freeSpace(config.run.workDir)
+	if err != nil {
+		logger.Warn("Could not read the available disk space, skipping disk space check", "error", err)
+		return nil
+	}
+	logger.Info("Checking disk space", "path", config.run.workDir,
+		"estimated", goutils.ConvertBytes(estimated), "available", goutils.ConvertBytes(available))
+	if estimated <= available {
+		return nil
+	}
+	// Only a part of the rows is dumped, the size of the tables overestimates the dump
+	if len(config.subset) > 0 {
+		logger.Warn("The tables of the subset are larger than the available disk space, the backup may not fit", "path", config.run.workDir,
+			"estimated", goutils.ConvertBytes(estimated), "available", goutils.ConvertBytes(available))
+		return nil
+	}
+	return fmt.Errorf("not enough disk space in %s: the backup needs up to %s but only %s is available, free some space or set BACKUP_TMP_DIR to a larger volume",
+		config.run.workDir, goutils.ConvertBytes(estimated), goutils.ConvertBytes(available))
+}
+
+// estimateDumpSize returns the size of the tables dumped by the backup, without their indexes.
+// All-in-one backups use the size of all databases of the instance.
+func estimateDumpSize(db *dbConfig, config *BackupConfig) (uint64, error) {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, db.connString())
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer func(conn *pgx.Conn, ctx context.Context) {
+		err = conn.Close(ctx)
+		if err != nil {
+			logger.Error("Error closing connexion", "error", err)
+		}
+	}(conn, ctx)
+
+	if config.all && config.allInOne {
+		var size int64
+		query := "SELECT COALESCE(SUM(pg_database_size(datname)), 0)::bigint FROM pg_database WHERE datallowconn"
+		if err = conn.QueryRow(ctx, query).Scan(&size); err != nil {
+			return 0, fmt.Errorf("failed to query database size: %w", err)
+		}
+		return uint64(size), nil
+	}
+	relations, err := config.tableFilter().selectedRelations(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	for _, r := range relations {
+		size += uint64(r.size)
+	}
+	return size, nil
+}
+
+// freeSpace returns the space available to unprivileged users in the given path
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
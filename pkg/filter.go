@@ -0,0 +1,220 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// queryer runs queries on a connection or in a transaction
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// relation is a table of the database
+type relation struct {
+	schema string
+	name   string
+	// visible is true when the table is found by its unqualified name in the search path
+	visible bool
+	// size is the size of the table data, without indexes
+	size int64
+}
+
+// key returns the schema-qualified table name
+func (r relation) key() string {
+	return r.schema + "." + r.name
+}
+
+// namePattern is a pg_dump table or schema pattern
+type namePattern struct {
+	schema *regexp.Regexp
+	name   *regexp.Regexp
+}
+
+// tableFilter holds the pg_dump filters of a backup
+type tableFilter struct {
+	tables           []namePattern
+	schemas          []namePattern
+	excludeTables    []namePattern
+	excludeSchemas   []namePattern
+	excludeTableData []namePattern
+}
+
+// parseNamePattern converts a pg_dump pattern to regular expressions, following the psql rules:
+// unquoted names are folded to lower case, * and ? are wildcards and a dot separates the schema
+func parseNamePattern(pattern string) namePattern {
+	var (
+		parts    []string
+		current  strings.Builder
+		inQuotes bool
+	)
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		ch := runes[i]
+		switch {
+		case ch == '"':
+			if inQuotes && i+1 < len(runes) && runes[i+1] == '"' {
+				current.WriteString(regexp.QuoteMeta(`"`))
+				i++
+				continue
+			}
+			inQuotes = !inQuotes
+		case !inQuotes && ch == '*':
+			current.WriteString(".*")
+		case !inQuotes && ch == '?':
+			current.WriteString(".")
+		case !inQuotes && ch == '.':
+			parts = append(parts, current.String())
+			current.Reset()
+		case !inQuotes:
+			current.WriteString(regexp.QuoteMeta(string(unicode.ToLower(ch))))
+		default:
+			current.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	parts = append(parts, current.String())
+	anchor := func(expr string) *regexp.Regexp {
+		return regexp.MustCompile("^(?:" + expr + ")$")
+	}
+	// A database name may prefix the schema, it is ignored
+	p := namePattern{name: anchor(parts[len(parts)-1])}
+	if len(parts) > 1 {
+		p.schema = anchor(parts[len(parts)-2])
+	}
+	return p
+}
+
+func parseNamePatterns(patterns []string) []namePattern {
+	var result []namePattern
+	for _, pattern := range patterns {
+		result = append(result, parseNamePattern(pattern))
+	}
+	return result
+}
+
+// matchTable reports whether the pattern matches the table, unqualified patterns only match visible tables
+func (p namePattern) matchTable(r relation) bool {
+	if p.schema == nil {
+		return r.visible && p.name.MatchString(r.name)
+	}
+	return p.schema.MatchString(r.schema) && p.name.MatchString(r.name)
+}
+
+// matchSchema reports whether the schema pattern matches the schema of the table
+func (p namePattern) matchSchema(r relation) bool {
+	return p.name.MatchString(r.schema)
+}
+
+// tableFilter returns the table filters of the backup
+func (c *BackupConfig) tableFilter() tableFilter {
+	return tableFilter{
+		tables:           parseNamePatterns(c.tables),
+		schemas:          parseNamePatterns(c.schemas),
+		excludeTables:    parseNamePatterns(c.excludeTables),
+		excludeSchemas:   parseNamePatterns(c.excludeSchemas),
+		excludeTableData: parseNamePatterns(c.excludeTableData),
+	}
+}
+
+// empty reports whether the backup dumps the data of every table
+func (f tableFilter) empty() bool {
+	return len(f.tables) == 0 && len(f.schemas) == 0 && len(f.excludeTables) == 0 &&
+		len(f.excludeSchemas) == 0 && len(f.excludeTableData) == 0
+}
+
+// dumpsData reports whether pg_dump dumps the data of the table.
+// As with pg_dump, the schema filters have no effect when tables are selected.
+func (f tableFilter) dumpsData(r relation) bool {
+	matchTable := func(patterns []namePattern) bool {
+		for _, p := range patterns {
+			if p.matchTable(r) {
+				return true
+			}
+		}
+		return false
+	}
+	matchSchema := func(patterns []namePattern) bool {
+		for _, p := range patterns {
+			if p.matchSchema(r) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(f.tables) > 0 {
+		if !matchTable(f.tables) {
+			return false
+		}
+	} else if (len(f.schemas) > 0 && !matchSchema(f.schemas)) || matchSchema(f.excludeSchemas) {
+		return false
+	}
+	return !matchTable(f.excludeTables) && !matchTable(f.excludeTableData)
+}
+
+// listRelations lists the tables of the database, excluding the system schemas
+func listRelations(ctx context.Context, q queryer) ([]relation, error) {
+	query := `SELECT n.nspname, c.relname, pg_table_is_visible(c.oid), pg_table_size(c.oid)
+	FROM pg_class c
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind IN ('r', 'p')
+	  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+	  AND n.nspname NOT LIKE 'pg\_toast%'
+	  AND n.nspname NOT LIKE 'pg\_temp%'`
+	rows, err := q.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	defer rows.Close()
+	var relations []relation
+	for rows.Next() {
+		var r relation
+		if err := rows.Scan(&r.schema, &r.name, &r.visible, &r.size); err != nil {
+			return nil, fmt.Errorf("failed to scan table: %w", err)
+		}
+		relations = append(relations, r)
+	}
+	return relations, rows.Err()
+}
+
+// selectedRelations returns the tables whose data is dumped with the filters, keyed by their schema-qualified name
+func (f tableFilter) selectedRelations(ctx context.Context, q queryer) (map[string]relation, error) {
+	relations, err := listRelations(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	selected := map[string]relation{}
+	for _, r := range relations {
+		if f.dumpsData(r) {
+			selected[r.key()] = r
+		}
+	}
+	return selected, nil
+}
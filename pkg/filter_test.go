@@ -0,0 +1,62 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import "testing"
+
+func TestTableFilterDumpsData(t *testing.T) {
+	customers := relation{schema: "public", name: "customers", visible: true}
+	audit := relation{schema: "audit", name: "Events"}
+	tests := []struct {
+		name     string
+		config   BackupConfig
+		relation relation
+		want     bool
+	}{
+		{"no filter", BackupConfig{}, customers, true},
+		{"unqualified table", BackupConfig{tables: []string{"customers"}}, customers, true},
+		{"unqualified table outside search path", BackupConfig{tables: []string{"events"}}, audit, false},
+		{"wildcard table", BackupConfig{tables: []string{"public.cust*"}}, customers, true},
+		{"single character wildcard", BackupConfig{tables: []string{"public.customer?"}}, customers, true},
+		{"other table", BackupConfig{tables: []string{"public.orders"}}, customers, false},
+		{"unquoted name is folded", BackupConfig{tables: []string{"audit.Events"}}, audit, false},
+		{"quoted name keeps case", BackupConfig{tables: []string{`audit."Events"`}}, audit, true},
+		{"database prefix", BackupConfig{tables: []string{`shop.audit."Events"`}}, audit, true},
+		{"dot is not a wildcard", BackupConfig{tables: []string{`"public.customers"`}}, customers, false},
+		{"schema", BackupConfig{schemas: []string{"audit"}}, customers, false},
+		{"schema ignored with tables", BackupConfig{tables: []string{"customers"}, schemas: []string{"audit"}}, customers, true},
+		{"excluded schema", BackupConfig{excludeSchemas: []string{"pub*"}}, customers, false},
+		{"excluded table", BackupConfig{excludeTables: []string{"public.customers"}}, customers, false},
+		{"excluded table data", BackupConfig{excludeTableData: []string{"customers"}}, customers, false},
+		{"excluded table among selected", BackupConfig{tables: []string{"*"}, excludeTables: []string{"customers"}}, customers, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.tableFilter().dumpsData(tt.relation); got != tt.want {
+				t.Errorf("dumpsData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
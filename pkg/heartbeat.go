@@ -0,0 +1,222 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"fmt"
+	goutils "github.com/jkaninda/go-utils"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPingBody is the size of the log tail sent with a ping
+const maxPingBody = 10000
+
+// heartbeat holds the URLs pinged when a backup job starts, succeeds or fails
+type heartbeat struct {
+	start   string
+	success string
+	fail    string
+}
+
+// loadHeartbeat loads the heartbeat URLs from HEARTBEAT_URL, HEARTBEAT_START_URL, HEARTBEAT_SUCCESS_URL and HEARTBEAT_FAIL_URL
+func loadHeartbeat() heartbeat {
+	hb := newHeartbeat(os.Getenv("HEARTBEAT_URL"))
+	if url := os.Getenv("HEARTBEAT_START_URL"); url != "" {
+		hb.start = url
+	}
+	if url := os.Getenv("HEARTBEAT_SUCCESS_URL"); url != "" {
+		hb.success = url
+	}
+	if url := os.Getenv("HEARTBEAT_FAIL_URL"); url != "" {
+		hb.fail = url
+	}
+	return hb
+}
+
+// newHeartbeat returns the healthchecks.io style URLs of a check: <url>/start, <url> and <url>/fail
+func newHeartbeat(url string) heartbeat {
+	if url == "" {
+		return heartbeat{}
+	}
+	url = strings.TrimRight(url, "/")
+	return heartbeat{start: url + "/start", success: url, fail: url + "/fail"}
+}
+
+func (hb heartbeat) started() {
+	ping(hb.start, "")
+}
+
+// finished pings the success or fail URL with the report of the runs
+func (hb heartbeat) finished(report string, failed bool) {
+	if failed {
+		ping(hb.fail, report)
+		return
+	}
+	ping(hb.success, report)
+}
+
+// ping sends the log tail to a heartbeat URL, errors are logged only
+func ping(url, body string) {
+	if url == "" {
+		return
+	}
+	if len(body) > maxPingBody {
+		body = body[len(body)-maxPingBody:]
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "text/plain; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		logger.Error("Error sending heartbeat ping", "error", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Error("Error sending heartbeat ping", "status", resp.Status)
+	}
+}
+
+// runsReport returns the result of each run, sent as the log tail of a ping
+func runsReport(name string, runs []*backupRun) (string, bool) {
+	var b strings.Builder
+	failed := false
+	for _, run := range runs {
+		if run.err != nil {
+			failed = true
+			_, _ = fmt.Fprintf(&b, "FAILED %s: %v\n", run.database, run.err)
+			continue
+		}
+		_, _ = fmt.Fprintf(&b, "OK %s: %s (%s) in %s\n", run.database, run.file,
+			goutils.ConvertBytes(uint64(run.size)), goutils.FormatDuration(run.duration, 0))
+	}
+	_, _ = fmt.Fprintf(&b, "Job %s: %d backups\n", name, len(runs))
+	return b.String(), failed
+}
+
+// watchdog notifies when a database has not been backed up successfully within the maximum age.
+// Databases are identified by their job and name, see watchKey.
+type watchdog struct {
+	maxAge    time.Duration
+	state     *schedulerState
+	mu        sync.Mutex
+	databases map[string]watchedDatabase
+	// history holds the last successful backups recorded before the start
+	history map[string]time.Time
+}
+
+// watchedDatabase is a database checked by the watchdog
+type watchedDatabase struct {
+	job        string
+	database   string
+	recipients *utils.Recipients
+}
+
+// watchKey identifies a database of a job, the same database may be backed up by several jobs
+func watchKey(job, database string) string {
+	return job + "/" + database
+}
+
+// newWatchdog creates a watchdog, the state persists its baselines and alerts across restarts
+func newWatchdog(maxAge time.Duration, state *schedulerState) *watchdog {
+	w := &watchdog{
+		maxAge:    maxAge,
+		state:     state,
+		databases: map[string]watchedDatabase{},
+		history:   map[string]time.Time{},
+	}
+	records, err := readHistory(historyFile(), historyFilter{status: historySuccess})
+	if err != nil {
+		logger.Warn("Could not read the run history, the watchdog only knows the backups since the start", "error", err)
+	}
+	for _, record := range records {
+		key := watchKey(record.Job, record.Database)
+		finishedAt := record.Time.Add(time.Duration(record.Duration * float64(time.Second)))
+		if finishedAt.After(w.history[key]) {
+			w.history[key] = finishedAt
+		}
+	}
+	return w
+}
+
+// watch adds a database of a job to check, recipients may be nil
+func (w *watchdog) watch(job, database string, recipients *utils.Recipients) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.databases[watchKey(job, database)] = watchedDatabase{job: job, database: database, recipients: recipients}
+}
+
+// start checks the databases every minute
+func (w *watchdog) start() {
+	logger.Info("Starting backup watchdog", "max_age", w.maxAge.String())
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.check(time.Now())
+	}
+}
+
+// check notifies once per database until a new backup succeeds,
+// databases backed up by all-databases jobs are checked once they have been backed up
+func (w *watchdog) check(now time.Time) {
+	lastSuccess := metrics.lastBackupSuccess()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, last := range lastSuccess {
+		if _, ok := w.databases[watchKey(key.job, key.database)]; !ok {
+			w.databases[watchKey(key.job, key.database)] = watchedDatabase{job: key.job, database: key.database}
+		}
+		if last.After(w.history[watchKey(key.job, key.database)]) {
+			w.history[watchKey(key.job, key.database)] = last
+		}
+	}
+	for key, db := range w.databases {
+		last, ok := w.history[key]
+		if !ok {
+			// Without any successful backup, the age is counted from the first time the database was watched
+			last = w.state.watchedSince(key, now)
+		}
+		if now.Sub(last) <= w.maxAge {
+			w.state.setAlerted(key, time.Time{})
+			continue
+		}
+		if alertedAt, ok := w.state.alertedAt(key); ok && !alertedAt.Before(last) {
+			continue
+		}
+		w.state.setAlerted(key, now)
+		msg := fmt.Sprintf("No successful backup of the %s database (job %s) since %s, the maximum age is %s",
+			db.database, db.job, last.Format(timeFormat), w.maxAge.String())
+		if !ok {
+			msg = fmt.Sprintf("No successful backup of the %s database (job %s) since %s, when it was first watched, the maximum age is %s",
+				db.database, db.job, last.Format(timeFormat), w.maxAge.String())
+		}
+		logger.Error("Backup is older than the maximum age", "job", db.job, "database", db.database, "max_age", w.maxAge.String())
+		utils.NotifyErrorTo(db.recipients, db.database, msg)
+	}
+}
@@ -25,14 +25,16 @@
 package pkg
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5"
+	gostorage "github.com/jkaninda/go-storage/pkg"
 	"github.com/jkaninda/logger"
 	"github.com/jkaninda/pg-bkup/utils"
 	"gopkg.in/yaml.v3"
-	"net/url"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -44,47 +46,45 @@ func intro() {
 	fmt.Println("Copyright (c) 2025 Jonas Kaninda")
 }
 
-// copyToTmp copy file to temporary directory
-func deleteTemp() {
-	logger.Info(fmt.Sprintf("Deleting %s ...", tmpPath))
-	err := filepath.Walk(tmpPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		// Check if the current item is a file
-		if !info.IsDir() {
-			// Delete the file
-			err = os.Remove(path)
-			if err != nil {
-				return err
-			}
-		}
+// pruneBackups deletes the backups older than the retention, and counts the deleted files when the storage can be listed
+func pruneBackups(st gostorage.Storage, config *BackupConfig) error {
+	storage := storageKind(config.storage)
+	if !canListBackups(storage) {
+		return st.Prune(config.backupRetention)
+	}
+	path := config.remotePath
+	if storage == LocalStorage {
+		path = config.localPath
+	}
+	before, listErr := listBackups(context.Background(), storage, path)
+	if err := st.Prune(config.backupRetention); err != nil {
+		return err
+	}
+	after, err := listBackups(context.Background(), storage, path)
+	if listErr != nil || err != nil {
 		return nil
-	})
-	if err != nil {
-		logger.Error("Error deleting files", "error", err)
-	} else {
-		logger.Info(fmt.Sprintf("Deleting %s ... done", tmpPath))
 	}
+	remaining := make(map[string]bool, len(after))
+	for _, backup := range after {
+		remaining[backup.Name] = true
+	}
+	deleted := 0
+	for _, backup := range before {
+		if !remaining[backup.Name] {
+			deleted++
+		}
+	}
+	metrics.pruned(config.jobName, string(config.storage), deleted)
+	return nil
 }
 
 // TestDatabaseConnection  tests the database connection
 func testDatabaseConnection(db *dbConfig) error {
 
 	logger.Info(fmt.Sprintf("Connecting to %s database ...", db.dbName))
-	connString := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", db.dbUserName, db.dbPassword, db.dbHost, db.dbPort, db.dbName)
-	// Create the PostgresSQL client config file
-	if err := createPGConfigFile(*db); err != nil {
-		return errors.New(err.Error())
-	}
-	// Set database name for notification error
-	utils.DatabaseName = db.dbName
-	if db.dbName == "" {
-		connString = fmt.Sprintf("postgres://%s:%s@%s:%s/postgres?sslmode=disable", db.dbUserName, db.dbPassword, db.dbHost, db.dbPort)
-	}
 
 	// Attempt to connect to the PostgreSQL server
-	conn, err := pgx.Connect(context.Background(), connString)
+	conn, err := pgx.Connect(context.Background(), db.connString())
 	if err != nil {
 		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
 	}
@@ -96,12 +96,13 @@ func testDatabaseConnection(db *dbConfig) error {
 		}
 	}(conn, context.Background())
 
-	// Optionally, execute a simple query to verify the connection
+	// Execute a simple query to verify the connection, the version is reported in the notifications
 	var version string
-	err = conn.QueryRow(context.Background(), "SELECT version()").Scan(&version)
+	err = conn.QueryRow(context.Background(), "SHOW server_version").Scan(&version)
 	if err != nil {
 		return fmt.Errorf("failed to execute query: %w", err)
 	}
+	db.serverVersion = version
 	logger.Info(fmt.Sprintf("Successfully connected to %s database", db.dbName))
 	return nil
 
@@ -153,8 +154,8 @@ func checkPrKeyFile(prKey string) (string, error) {
 	return "", fmt.Errorf("no public key file found")
 }
 
-// readConf reads config file and returns Config
-func readConf(configFile string) (*Config, error) {
+// readConf reads config file and returns Config, unknown fields are rejected in strict mode
+func readConf(configFile string, strict bool) (*Config, error) {
 	if utils.FileExists(configFile) {
 		buf, err := os.ReadFile(configFile)
 		if err != nil {
@@ -162,12 +163,14 @@ func readConf(configFile string) (*Config, error) {
 		}
 
 		c := &Config{}
-		err = yaml.Unmarshal(buf, c)
-		if err != nil {
+		decoder := yaml.NewDecoder(bytes.NewReader(buf))
+		decoder.KnownFields(strict)
+		err = decoder.Decode(c)
+		if err != nil && !errors.Is(err, io.EOF) {
 			return nil, fmt.Errorf("in file %q: %w", configFile, err)
 		}
 
-		return c, err
+		return c, nil
 	}
 	return nil, fmt.Errorf("config file %q not found", configFile)
 }
@@ -202,45 +205,3 @@ func RemoveLastExtension(filename string) string {
 	}
 	return filename
 }
-func convertJDBCToDbConfig(jdbcURI string) (*dbConfig, error) {
-	// Remove the "jdbc:" prefix
-	jdbcURI = strings.TrimPrefix(jdbcURI, "jdbc:")
-	// Parse the URI
-	u, err := url.Parse(jdbcURI)
-	if err != nil {
-		return &dbConfig{}, fmt.Errorf("failed to parse JDBC URI: %v", err)
-	}
-	// Extract components
-	host := u.Hostname()
-	port := u.Port()
-	if port == "" {
-		port = "5432" // Default PostgreSQL port
-	}
-	database := strings.TrimPrefix(u.Path, "/")
-	params, _ := url.ParseQuery(u.RawQuery)
-	username := params.Get("user")
-	password := params.Get("password")
-	// Validate essential fields
-	if host == "" || database == "" || username == "" {
-		return &dbConfig{}, fmt.Errorf("incomplete JDBC URI: missing host, database, or username")
-	}
-
-	return &dbConfig{
-		dbHost:     host,
-		dbPort:     port,
-		dbName:     database,
-		dbUserName: username,
-		dbPassword: password,
-	}, nil
-}
-
-// Create mysql client config file
-func createPGConfigFile(db dbConfig) error {
-
-	// Set the environment variable for the database password
-	err := os.Setenv("PGPASSWORD", db.dbPassword)
-	if err != nil {
-		return fmt.Errorf("failed to set PGPASSWORD environment variable: %v", err)
-	}
-	return nil
-}
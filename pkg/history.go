@@ -0,0 +1,384 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	goutils "github.com/jkaninda/go-utils"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Trigger sources of a backup run
+const (
+	triggerManual   = "manual"
+	triggerSchedule = "schedule"
+	triggerAPI      = "api"
+)
+
+// Status of a backup run
+const (
+	historySuccess = "success"
+	historyFailed  = "failed"
+)
+
+// historyRecord is a line of the run history file
+type historyRecord struct {
+	Time     time.Time `json:"time"`
+	Job      string    `json:"job,omitempty"`
+	Database string    `json:"database"`
+	Storage  string    `json:"storage"`
+	File     string    `json:"file,omitempty"`
+	Location string    `json:"location,omitempty"`
+	Size     int64     `json:"size"`
+	Checksum string    `json:"checksum,omitempty"`
+	Duration float64   `json:"duration"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Trigger  string    `json:"trigger"`
+}
+
+// historyFilter selects the records of the run history
+type historyFilter struct {
+	job      string
+	database string
+	storage  string
+	status   string
+	since    time.Time
+	limit    int
+}
+
+// historyMu serializes the writes of concurrent runs
+var historyMu sync.Mutex
+
+// historyFile returns the path of the run history file
+func historyFile() string {
+	return utils.EnvWithDefault("BACKUP_HISTORY_FILE", defaultHistoryFile)
+}
+
+// historyMaxRecords returns the number of runs kept in the history file, 0 keeps all runs
+func historyMaxRecords() int {
+	value := os.Getenv("BACKUP_HISTORY_MAX_RECORDS")
+	if value == "" {
+		return defaultHistoryMaxRecords
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		logger.Warn("Invalid BACKUP_HISTORY_MAX_RECORDS, using the default", "value", value, "default", defaultHistoryMaxRecords)
+		return defaultHistoryMaxRecords
+	}
+	return n
+}
+
+// maxHistoryError bounds the error of a record, the output of the PG client tools can be very long
+const maxHistoryError = 4096
+
+// maxHistoryLine bounds the records read from the history file, longer lines are skipped
+const maxHistoryLine = 1024 * 1024
+
+// newHistoryRecord returns the history record of a run
+func newHistoryRecord(run *backupRun, trigger string) historyRecord {
+	record := historyRecord{
+		Time:     run.startTime.UTC(),
+		Job:      run.job,
+		Database: run.database,
+		Storage:  run.storage,
+		File:     run.file,
+		Location: run.location,
+		Size:     run.size,
+		Checksum: run.checksum,
+		Duration: run.duration.Seconds(),
+		Status:   historySuccess,
+		Trigger:  trigger,
+	}
+	if run.err != nil {
+		record.Status = historyFailed
+		record.Error = run.err.Error()
+		if len(record.Error) > maxHistoryError {
+			// The end of the output holds the error
+			record.Error = "..." + strings.ToValidUTF8(record.Error[len(record.Error)-maxHistoryError:], "")
+		}
+		record.Duration = time.Since(run.startTime).Seconds()
+	}
+	return record
+}
+
+// recordHistory appends the run to the history file and the catalog, errors are logged only
+func recordHistory(run *backupRun, config *BackupConfig) {
+	record := newHistoryRecord(run, config.trigger)
+	appendHistory(record)
+	config.catalog.record(record)
+}
+
+// appendHistory appends a record to the history file
+func appendHistory(record historyRecord) {
+	path := historyFile()
+	line, err := json.Marshal(record)
+	if err != nil {
+		logger.Error("Error encoding run history", "error", err)
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logger.Error("Error writing run history", "path", path, "error", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Error("Error writing run history", "path", path, "error", err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		logger.Error("Error writing run history", "path", path, "error", err)
+		return
+	}
+	if err := trimHistory(path, historyMaxRecords()); err != nil {
+		logger.Error("Error trimming run history", "path", path, "error", err)
+	}
+}
+
+// trimHistory keeps the last max records of the history file. The file is only rewritten
+// when it exceeds the limit by 10%, so that it is not rewritten after every run.
+func trimHistory(path string, max int) error {
+	if max == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= max+max/10 {
+		return nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines[len(lines)-max:], "")), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// latestBackup returns the last successful backup of a database on a storage
+func latestBackup(database string, storage StorageType) (historyRecord, error) {
+	records, err := readHistory(historyFile(), historyFilter{database: database, status: historySuccess})
+	if err != nil {
+		return historyRecord{}, err
+	}
+	for _, record := range records {
+		if record.File != "" && storageKind(StorageType(record.Storage)) == storageKind(storage) {
+			return record, nil
+		}
+	}
+	return historyRecord{}, fmt.Errorf("no successful backup of the %s database on %s storage in the run history", database, storage)
+}
+
+// match reports whether a record is selected by the filter
+func (f historyFilter) match(record historyRecord) bool {
+	return (f.job == "" || record.Job == f.job) &&
+		(f.database == "" || record.Database == f.database) &&
+		(f.storage == "" || record.Storage == f.storage) &&
+		(f.status == "" || record.Status == f.status) &&
+		!record.Time.Before(f.since)
+}
+
+// readHistory returns the matching records, newest first
+func readHistory(path string, filter historyFilter) ([]historyRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []historyRecord{}, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	records := []historyRecord{}
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, tooLong, err := readHistoryLine(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tooLong {
+			logger.Warn("Skipping oversize run history record", "path", path, "line", n)
+			continue
+		}
+		var record historyRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			logger.Warn("Skipping invalid run history record", "path", path, "line", n, "error", err)
+			continue
+		}
+		if filter.match(record) {
+			records = append(records, record)
+		}
+	}
+	// Records are appended, the newest ones are at the end of the file
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	if filter.limit > 0 && len(records) > filter.limit {
+		records = records[:filter.limit]
+	}
+	return records, nil
+}
+
+// readHistoryLine reads a line of the history file, lines longer than maxHistoryLine are read but not returned
+func readHistoryLine(reader *bufio.Reader) ([]byte, bool, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+			if len(line) > maxHistoryLine {
+				tooLong, line = true, nil
+			}
+		}
+		if !isPrefix {
+			return line, tooLong, nil
+		}
+	}
+}
+
+// fileChecksum returns the SHA-256 checksum of a file, errors are logged only
+func fileChecksum(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		logger.Error("Error computing backup checksum", "error", err)
+		return ""
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		logger.Error("Error computing backup checksum", "error", err)
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parseSince parses a duration, such as 24h or 7d, or a date
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a duration such as 24h or 7d, or a date such as 2006-01-02", value)
+}
+
+// ShowHistory prints the run history
+func ShowHistory(cmd *cobra.Command) {
+	since, err := parseSince(utils.FlagGetString(cmd, "since"))
+	if err != nil {
+		logger.Fatal("Error reading --since", "error", err)
+	}
+	status := utils.FlagGetString(cmd, "status")
+	if status != "" && status != historySuccess && status != historyFailed {
+		logger.Fatal("Invalid status, expected success or failed", "status", status)
+	}
+	limit, _ := cmd.Flags().GetInt("limit")
+	filter := historyFilter{
+		job:      utils.FlagGetString(cmd, "job"),
+		database: utils.FlagGetString(cmd, "dbname"),
+		storage:  utils.FlagGetString(cmd, "storage"),
+		status:   status,
+		since:    since,
+		limit:    limit,
+	}
+	records, err := readHistory(historyFile(), filter)
+	if err != nil {
+		logger.Fatal("Error reading run history", "path", historyFile(), "error", err)
+	}
+	switch output := utils.FlagGetString(cmd, "output"); output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(records); err != nil {
+			logger.Fatal("Error writing run history", "error", err)
+		}
+	case "", "table":
+		printHistory(os.Stdout, records)
+	default:
+		logger.Fatal("Invalid output, expected table or json", "output", output)
+	}
+}
+
+// printHistory writes the records as a table
+func printHistory(w io.Writer, records []historyRecord) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "TIME\tJOB\tDATABASE\tSTORAGE\tSTATUS\tSIZE\tDURATION\tTRIGGER\tFILE")
+	for _, r := range records {
+		file := r.File
+		if r.Status == historyFailed {
+			file = strings.ReplaceAll(r.Error, "\n", " ")
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Time.Local().Format(time.DateTime), dash(r.Job), r.Database, r.Storage, r.Status,
+			goutils.ConvertBytes(uint64(r.Size)), goutils.FormatDuration(time.Duration(r.Duration*float64(time.Second)).Round(time.Millisecond), 0),
+			r.Trigger, dash(file))
+	}
+	_ = tw.Flush()
+}
+
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,96 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"empty", "", time.Time{}, false},
+		{"hours", "24h", now.Add(-24 * time.Hour), false},
+		{"days", "7d", now.AddDate(0, 0, -7), false},
+		{"date", "2024-12-20", time.Date(2024, 12, 20, 0, 0, 0, 0, time.Local), false},
+		{"date and time", "2024-12-20 02:30:00", time.Date(2024, 12, 20, 2, 30, 0, 0, time.Local), false},
+		{"RFC 3339", "2024-12-20T02:30:00Z", time.Date(2024, 12, 20, 2, 30, 0, 0, time.UTC), false},
+		{"negative days", "-3d", time.Time{}, true},
+		{"unknown", "last week", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSince(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSince() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// Relative values depend on the current time
+			if diff := got.Sub(tt.want); diff < -time.Minute || diff > time.Minute {
+				t.Errorf("parseSince() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewHistoryRecordTruncatesError(t *testing.T) {
+	output := strings.Repeat("pg_dump: warning\n", 100000) + "pg_dump: error: connection lost"
+	run := &backupRun{database: "shop", startTime: time.Now(), err: errors.New(output)}
+	record := newHistoryRecord(run, triggerManual)
+	if len(record.Error) > maxHistoryError+3 {
+		t.Errorf("error length = %d, want at most %d", len(record.Error), maxHistoryError+3)
+	}
+	if !strings.HasSuffix(record.Error, "connection lost") {
+		t.Errorf("error does not end with the last output line: %q", record.Error[len(record.Error)-40:])
+	}
+}
+
+func TestReadHistorySkipsOversizeLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	lines := []string{
+		`{"time":"2024-12-20T02:00:00Z","database":"shop","status":"success"}`,
+		`{"time":"2024-12-20T03:00:00Z","database":"shop","status":"failed","error":"` + strings.Repeat("x", 2*maxHistoryLine) + `"}`,
+		`{"time":"2024-12-20T04:00:00Z","database":"crm","status":"success"}`,
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	records, err := readHistory(path, historyFilter{})
+	if err != nil {
+		t.Fatalf("readHistory() error = %v", err)
+	}
+	if len(records) != 2 || records[0].Database != "crm" || records[1].Database != "shop" {
+		t.Errorf("readHistory() = %+v, want the crm and shop records", records)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"fmt"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"net"
+)
+
+// backupJob is a job resolved against the databases section
+type backupJob struct {
+	Job
+	databases []Database
+}
+
+// resolveJobs returns the jobs defined in the config file.
+// Without jobs section, databases sharing the same cron expression are grouped in one job.
+func resolveJobs(conf *Config, cronExpression string) ([]backupJob, error) {
+	if len(conf.Jobs) == 0 {
+		return groupDatabases(conf.Databases, cronExpression)
+	}
+	jobs := make([]backupJob, 0, len(conf.Jobs))
+	names := map[string]bool{}
+	for i, job := range conf.Jobs {
+		if job.Name == "" {
+			job.Name = fmt.Sprintf("job-%d", i+1)
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("duplicate job name %q", job.Name)
+		}
+		names[job.Name] = true
+		if job.CronExpression == "" {
+			job.CronExpression = cronExpression
+		}
+		if job.CronExpression != "" && !utils.IsValidCronExpression(job.CronExpression) {
+			return nil, fmt.Errorf("job %q: cron expression %q is not valid", job.Name, job.CronExpression)
+		}
+		switch job.Type {
+		case "", FullBackup, SchemaOnlyBackup, DataOnlyBackup, AllDatabasesBackup, AllInOneBackup:
+		default:
+			return nil, fmt.Errorf("job %q: unknown backup type %q", job.Name, job.Type)
+		}
+		databases, err := jobDatabases(conf.Databases, job)
+		if err != nil {
+			return nil, err
+		}
+		if job.Type == AllDatabasesBackup || job.Type == AllInOneBackup {
+			databases = instanceDatabases(job.Name, databases)
+		}
+		jobs = append(jobs, backupJob{Job: job, databases: databases})
+	}
+	return jobs, nil
+}
+
+// jobDatabases returns the databases referenced by a job
+func jobDatabases(databases []Database, job Job) ([]Database, error) {
+	if len(job.Databases) == 0 {
+		return databases, nil
+	}
+	selected := make([]Database, 0, len(job.Databases))
+	for _, name := range job.Databases {
+		found := false
+		for _, db := range databases {
+			if db.Name == name {
+				selected = append(selected, db)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("job %q: database %q not found in databases section", job.Name, name)
+		}
+	}
+	return selected, nil
+}
+
+// instanceDatabases keeps the first database of each instance, all-databases and all-in-one jobs
+// back up whole instances and connect through that database
+func instanceDatabases(job string, databases []Database) []Database {
+	selected := make([]Database, 0, len(databases))
+	instances := map[string]string{}
+	for _, db := range databases {
+		key := instanceKey(db)
+		if first, ok := instances[key]; ok {
+			logger.Info("Skipping database, its instance is already backed up by the job", "job", job, "database", db.Name, "instance", first)
+			continue
+		}
+		instances[key] = db.Name
+		selected = append(selected, db)
+	}
+	return selected
+}
+
+// instanceKey identifies the PostgreSQL instance of a database, resolved as getDatabase does
+func instanceKey(db Database) string {
+	name := utils.ReplaceEnvVars(db.Name)
+	service := utils.ReplaceEnvVars(getEnvOrDefault(db.Service, "DB_SERVICE", name, ""))
+	if service != "" {
+		return "service=" + service
+	}
+	host := utils.ReplaceEnvVars(getEnvOrDefault(db.Host, "DB_HOST", name, ""))
+	port := utils.ReplaceEnvVars(getEnvOrDefault(db.Port, "DB_PORT", name, defaultDbPort))
+	return net.JoinHostPort(host, port)
+}
+
+// groupDatabases groups databases by cron expression
+func groupDatabases(databases []Database, cronExpression string) ([]backupJob, error) {
+	var jobs []backupJob
+	index := map[string]int{}
+	for _, db := range databases {
+		expression := cronExpression
+		if db.CronExpression != "" {
+			expression = db.CronExpression
+		}
+		if expression != "" && !utils.IsValidCronExpression(expression) {
+			return nil, fmt.Errorf("database %q: cron expression %q is not valid", db.Name, expression)
+		}
+		i, ok := index[expression]
+		if !ok {
+			i = len(jobs)
+			index[expression] = i
+			jobs = append(jobs, backupJob{Job: Job{Name: fmt.Sprintf("job-%d", i+1), CronExpression: expression}})
+		}
+		jobs[i].databases = append(jobs[i].databases, db)
+	}
+	return jobs, nil
+}
+
+// selectJobs returns the jobs with the given names
+func selectJobs(jobs []backupJob, names []string) ([]backupJob, error) {
+	selected := make([]backupJob, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, job := range jobs {
+			if job.Name == name {
+				selected = append(selected, job)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("job %q not found", name)
+		}
+	}
+	return selected, nil
+}
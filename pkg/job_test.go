@@ -0,0 +1,84 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import "testing"
+
+func TestNewJobBackupConfigPrecedence(t *testing.T) {
+	jobDays, dbDays := 7, 30
+	global := &BackupConfig{storage: LocalStorage, remotePath: "/global", localPath: storagePath, backupRetention: 1}
+	job := Job{Name: "nightly", Storage: "s3", Path: "/job", BackupRetentionDays: &jobDays, Type: SchemaOnlyBackup}
+	tests := []struct {
+		name       string
+		db         Database
+		storage    StorageType
+		path       string
+		retention  int
+		schemaOnly bool
+		dataOnly   bool
+	}{
+		{"job settings", Database{Name: "app"}, S3Storage, "/job", jobDays, true, false},
+		{"database storage", Database{Name: "app", Storage: "ssh"}, SSHStorage, "/job", jobDays, true, false},
+		{"database path", Database{Name: "app", Path: "/db"}, S3Storage, "/db", jobDays, true, false},
+		{"database retention", Database{Name: "app", BackupRetentionDays: &dbDays}, S3Storage, "/job", dbDays, true, false},
+		{"database type", Database{Name: "app", DataOnly: true}, S3Storage, "/job", jobDays, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newJobBackupConfig(global, tt.db, job)
+			if config.storage != tt.storage || config.remotePath != tt.path || config.localPath != tt.path || config.backupRetention != tt.retention {
+				t.Errorf("got storage %q, path %q, retention %d, want %q, %q, %d",
+					config.storage, config.remotePath, config.backupRetention, tt.storage, tt.path, tt.retention)
+			}
+			if config.schemaOnly != tt.schemaOnly || config.dataOnly != tt.dataOnly {
+				t.Errorf("got schemaOnly %v, dataOnly %v, want %v, %v", config.schemaOnly, config.dataOnly, tt.schemaOnly, tt.dataOnly)
+			}
+		})
+	}
+}
+
+func TestInstanceDatabases(t *testing.T) {
+	databases := []Database{
+		{Name: "app", Host: "db1", Port: "5432"},
+		{Name: "billing", Host: "db1", Port: "5432"},
+		{Name: "reports", Host: "db1", Port: "5433"},
+		{Name: "crm", Host: "db2", Port: "5432"},
+		{Name: "audit", Service: "audit"},
+		{Name: "archive", Service: "audit"},
+	}
+	var got []string
+	for _, db := range instanceDatabases("nightly", databases) {
+		got = append(got, db.Name)
+	}
+	want := []string{"app", "reports", "crm", "audit"}
+	if len(got) != len(want) {
+		t.Fatalf("instanceDatabases() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("instanceDatabases() = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Masking strategies
+const (
+	MaskHash      MaskingStrategy = "hash"
+	MaskFakeEmail MaskingStrategy = "fake_email"
+	MaskNull      MaskingStrategy = "null"
+	MaskFixed     MaskingStrategy = "fixed"
+	MaskPartial   MaskingStrategy = "partial"
+)
+
+const defaultMaskKeep = 2
+
+// maskedColumn describes a column of a masked table as found in the live schema
+type maskedColumn struct {
+	name      string
+	nullable  bool
+	generated bool
+	isText    bool
+	maxLength int
+	typeName  string
+}
+
+// maskedTable holds the resolved SELECT used to export a masked table
+type maskedTable struct {
+	schema  string
+	name    string
+	columns []string
+	selects []string
+}
+
+// readMaskingProfile reads and checks a masking profile file
+func readMaskingProfile(profileFile string) (*MaskingProfile, error) {
+	buf, err := os.ReadFile(profileFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read masking profile: %w", err)
+	}
+	profile := &MaskingProfile{}
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(profile); err != nil {
+		return nil, fmt.Errorf("in file %q: %w", profileFile, err)
+	}
+	if len(profile.Rules) == 0 {
+		return nil, fmt.Errorf("masking profile %q has no rules", profileFile)
+	}
+	profile.Salt = utils.ReplaceEnvVars(profile.Salt)
+	for i, rule := range profile.Rules {
+		if rule.Table == "" || rule.Column == "" {
+			return nil, fmt.Errorf("masking rule #%d: table and column are required", i+1)
+		}
+		switch rule.Strategy {
+		case MaskHash, MaskFakeEmail, MaskNull, MaskFixed, MaskPartial:
+		default:
+			return nil, fmt.Errorf("masking rule #%d: unknown strategy %q", i+1, rule.Strategy)
+		}
+		if rule.Keep < 0 {
+			return nil, fmt.Errorf("masking rule #%d: keep must be positive", i+1)
+		}
+	}
+	return profile, nil
+}
+
+// splitTableName returns the schema and table name, defaulting to the public schema
+func splitTableName(table string) (string, string) {
+	if schema, name, found := strings.Cut(table, "."); found {
+		return schema, name
+	}
+	return "public", table
+}
+
+// resolve validates the profile against the live schema and builds the masked SELECT of each table.
+// Tables whose data is excluded by the backup filters are skipped.
+func (p *MaskingProfile) resolve(ctx context.Context, conn *pgx.Conn, filter tableFilter) ([]maskedTable, error) {
+	var (
+		tables []maskedTable
+		errs   []error
+	)
+	relations := map[string]relation{}
+	if !filter.empty() {
+		list, err := listRelations(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range list {
+			relations[r.key()] = r
+		}
+	}
+	rulesByTable := map[string][]MaskingRule{}
+	var order []string
+	for _, rule := range p.Rules {
+		schema, name := splitTableName(rule.Table)
+		key := schema + "." + name
+		if _, ok := rulesByTable[key]; !ok {
+			order = append(order, key)
+		}
+		rulesByTable[key] = append(rulesByTable[key], rule)
+	}
+	for _, key := range order {
+		if r, ok := relations[key]; ok && !filter.dumpsData(r) {
+			logger.Info("Skipping masking rules of a table excluded from the backup", "table", key)
+			continue
+		}
+		schema, name := splitTableName(key)
+		columns, err := tableColumns(ctx, conn, schema, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(columns) == 0 {
+			errs = append(errs, fmt.Errorf("table %s does not exist", key))
+			continue
+		}
+		table := maskedTable{schema: schema, name: name}
+		rules := map[string]MaskingRule{}
+		for _, rule := range rulesByTable[key] {
+			rules[rule.Column] = rule
+		}
+		found := map[string]bool{}
+		for _, column := range columns {
+			// Generated columns are not part of pg_dump data
+			if column.generated {
+				continue
+			}
+			ident := pgx.Identifier{column.name}.Sanitize()
+			table.columns = append(table.columns, ident)
+			rule, ok := rules[column.name]
+			if !ok {
+				table.selects = append(table.selects, ident)
+				continue
+			}
+			found[column.name] = true
+			expr, err := maskExpression(ctx, conn, rule, column, p.Salt)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.%s: %w", key, column.name, err))
+				continue
+			}
+			table.selects = append(table.selects, expr)
+		}
+		for column := range rules {
+			if !found[column] {
+				errs = append(errs, fmt.Errorf("column %s does not exist in table %s", column, key))
+			}
+		}
+		tables = append(tables, table)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid masking profile: %w", errors.Join(errs...))
+	}
+	return tables, nil
+}
+
+// tableColumns lists the columns of a table in their physical order
+func tableColumns(ctx context.Context, conn *pgx.Conn, schema, table string) ([]maskedColumn, error) {
+	query := `SELECT c.column_name,
+	       c.is_nullable = 'YES',
+	       c.is_generated = 'ALWAYS',
+	       COALESCE(t.typcategory = 'S', false),
+	       COALESCE(c.character_maximum_length, 0)::int,
+	       quote_ident(c.udt_schema) || '.' || quote_ident(c.udt_name)
+	FROM information_schema.columns c
+	LEFT JOIN pg_namespace n ON n.nspname = c.udt_schema
+	LEFT JOIN pg_type t ON t.typname = c.udt_name AND t.typnamespace = n.oid
+	WHERE c.table_schema = $1 AND c.table_name = $2
+	ORDER BY c.ordinal_position`
+	rows, err := conn.Query(ctx, query, schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query columns of %s.%s: %w", schema, table, err)
+	}
+	defer rows.Close()
+	var columns []maskedColumn
+	for rows.Next() {
+		var column maskedColumn
+		var maxLength int32
+		if err := rows.Scan(&column.name, &column.nullable, &column.generated, &column.isText, &maxLength, &column.typeName); err != nil {
+			return nil, fmt.Errorf("failed to scan column: %w", err)
+		}
+		column.maxLength = int(maxLength)
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// maskExpression returns the SQL expression replacing the column value, hashes are prefixed with the salt
+func maskExpression(ctx context.Context, conn *pgx.Conn, rule MaskingRule, column maskedColumn, salt string) (string, error) {
+	ident := pgx.Identifier{column.name}.Sanitize()
+	var expr string
+	switch rule.Strategy {
+	case MaskNull:
+		if !column.nullable {
+			return "", fmt.Errorf("strategy null requires a nullable column")
+		}
+		return "NULL", nil
+	case MaskFixed:
+		// Make sure the value can be loaded into the column
+		if _, err := conn.Exec(ctx, fmt.Sprintf("SELECT $1::text::%s", column.typeName), rule.Value); err != nil {
+			return "", fmt.Errorf("value %q is not valid for type %s: %w", rule.Value, column.typeName, err)
+		}
+		return quoteLiteral(rule.Value), nil
+	case MaskHash:
+		expr = fmt.Sprintf("md5(%s || %s::text)", quoteLiteral(salt), ident)
+	case MaskFakeEmail:
+		expr = fmt.Sprintf("'user_' || left(md5(%s || %s::text), 12) || '@example.com'", quoteLiteral(salt), ident)
+	case MaskPartial:
+		keep := rule.Keep
+		if keep == 0 {
+			keep = defaultMaskKeep
+		}
+		expr = fmt.Sprintf("left(%[1]s::text, %[2]d) || repeat('*', greatest(length(%[1]s::text) - %[2]d, 0))", ident, keep)
+	}
+	if !column.isText {
+		return "", fmt.Errorf("strategy %s requires a text column", rule.Strategy)
+	}
+	if column.maxLength > 0 {
+		expr = fmt.Sprintf("left(%s, %d)", expr, column.maxLength)
+	}
+	return fmt.Sprintf("CASE WHEN %s IS NULL THEN NULL ELSE %s END", ident, expr), nil
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// qualifiedName returns the quoted schema-qualified table name
+func (t maskedTable) qualifiedName() string {
+	return pgx.Identifier{t.schema, t.name}.Sanitize()
+}
+
+// dumpWithMasking dumps the database, replacing the data of masked tables with their masked SELECT.
+// All parts are read from the same exported snapshot, so the dump stays consistent.
+func dumpWithMasking(db *dbConfig, config *BackupConfig, dumpArgs []string, outputPath string) error {
+	ctx := context.Background()
+	conn, err := dbConnect(db)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer func(conn *pgx.Conn, ctx context.Context) {
+		err := conn.Close(ctx)
+		if err != nil {
+			logger.Error("Error closing connection", "error", err)
+		}
+	}(conn, ctx)
+
+	logger.Info("Validating masking profile...", "rules", len(config.masking.Rules))
+	tables, err := config.masking.resolve(ctx, conn, config.tableFilter())
+	if err != nil {
+		return err
+	}
+	logger.Info("Validating masking profile...done", "tables", len(tables))
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+	var snapshot string
+	if err = tx.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&snapshot); err != nil {
+		return fmt.Errorf("failed to export snapshot: %w", err)
+	}
+
+	out, closeOut, err := createDumpWriter(outputPath, !config.disableCompression)
+	if err != nil {
+		return err
+	}
+	defer closeOut()
+
+	// Sections are dumped separately, --data-only is expressed as the data section
+	args := []string{"--snapshot", snapshot}
+	for _, arg := range dumpArgs {
+		if arg != "--data-only" {
+			args = append(args, arg)
+		}
+	}
+	for _, table := range tables {
+		args = append(args, "--exclude-table-data", table.qualifiedName())
+	}
+	sections := []string{"--section=pre-data", "--section=data"}
+	if config.dataOnly {
+		sections = []string{"--section=data"}
+	}
+	if err = runDumpSection(out, args, sections); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		logger.Info("Dumping masked table", "table", table.qualifiedName())
+		if err = writeTableData(ctx, tx, out, table, ""); err != nil {
+			return err
+		}
+	}
+	if !config.dataOnly {
+		if err = runDumpSection(out, args, []string{"--section=post-data"}); err != nil {
+			return err
+		}
+	}
+	logger.Info("Database has been backed up with masked data")
+	return nil
+}
+
+// createDumpWriter creates the backup file, optionally gzip-compressed
+func createDumpWriter(outputPath string, compress bool) (io.Writer, func(), error) {
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create backup file: %w", err)
+	}
+	if !compress {
+		return outFile, func() {
+			if err := outFile.Close(); err != nil {
+				logger.Error("Error closing backup file", "error", err)
+			}
+		}, nil
+	}
+	gzipWriter := gzip.NewWriter(outFile)
+	return gzipWriter, func() {
+		if err := gzipWriter.Close(); err != nil {
+			logger.Error("Error closing gzip writer", "error", err)
+		}
+		if err := outFile.Close(); err != nil {
+			logger.Error("Error closing backup file", "error", err)
+		}
+	}, nil
+}
+
+// writeTableData writes the table rows as a COPY block, in the format produced by pg_dump
+func writeTableData(ctx context.Context, tx pgx.Tx, out io.Writer, table maskedTable, where string) error {
+	_, err := fmt.Fprintf(out, "\n--\n-- Data for %s\n--\n\nCOPY %s (%s) FROM stdin;\n", table.qualifiedName(), table.qualifiedName(), strings.Join(table.columns, ", "))
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("COPY (SELECT %s FROM %s%s) TO STDOUT", strings.Join(table.selects, ", "), table.qualifiedName(), where)
+	if _, err = tx.Conn().PgConn().CopyTo(ctx, out, query); err != nil {
+		return fmt.Errorf("failed to dump table %s: %w", table.qualifiedName(), err)
+	}
+	_, err = io.WriteString(out, "\\.\n\n")
+	return err
+}
+
+// runDumpSection runs pg_dump for the given sections and writes the output to out
+func runDumpSection(out io.Writer, args, sections []string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("pg_dump", append(args, sections...)...)
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to execute pg_dump: %w, output: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// initMaskingProfile loads the masking profile from the flag or the MASKING_PROFILE environment variable
+func initMaskingProfile(profileFile string) *MaskingProfile {
+	if profileFile == "" {
+		return nil
+	}
+	if !utils.FileExists(profileFile) {
+		logger.Fatal("Masking profile not found", "file", profileFile)
+	}
+	profile, err := readMaskingProfile(profileFile)
+	if err != nil {
+		logger.Fatal("Error loading masking profile", "error", err)
+	}
+	if profile.Salt == "" {
+		logger.Warn("Masking profile has no salt, hashed values can be matched against known values", "file", profileFile)
+	}
+	return profile
+}
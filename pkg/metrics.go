@@ -0,0 +1,303 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"fmt"
+	"github.com/jkaninda/logger"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations reported by the metrics
+const (
+	backupOperation  = "backup"
+	restoreOperation = "restore"
+	migrateOperation = "migrate"
+)
+
+// metrics holds the metrics of the process, exposed in the Prometheus text format or pushed at the end of a run
+var metrics = &metricsRegistry{
+	last:         map[operationKey]operationStats{},
+	failures:     map[operationKey]int{},
+	pruneDeleted: map[metricKey]int{},
+	uploadBytes:  map[metricKey]int64{},
+	lastFailed:   map[operationKey]bool{},
+	lastUpload:   map[metricKey]int64{},
+}
+
+// metricKey identifies the series of a job, database and storage
+type metricKey struct {
+	job      string
+	database string
+	storage  string
+}
+
+// operationKey identifies the series of an operation
+type operationKey struct {
+	operation string
+	metricKey
+}
+
+// operationStats holds the last successful run of an operation
+type operationStats struct {
+	lastSuccess time.Time
+	duration    time.Duration
+	size        int64
+}
+
+// metricSample is a single value of a metric
+type metricSample struct {
+	name   string
+	kind   string
+	help   string
+	labels [][2]string
+	value  float64
+}
+
+type metricsRegistry struct {
+	mu           sync.Mutex
+	last         map[operationKey]operationStats
+	failures     map[operationKey]int
+	pruneDeleted map[metricKey]int
+	uploadBytes  map[metricKey]int64
+	// lastFailed and lastUpload describe the last run, they stay meaningful when a one-shot process pushes its metrics
+	lastFailed map[operationKey]bool
+	lastUpload map[metricKey]int64
+}
+
+// runStarted resets the bytes uploaded by the last run of the job
+func (m *metricsRegistry) runStarted(job string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.lastUpload {
+		if key.job == job {
+			m.lastUpload[key] = 0
+		}
+	}
+}
+
+// succeeded records a successful run with the values sent in the notification
+func (m *metricsRegistry) succeeded(operation string, key metricKey, size int64, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last[operationKey{operation, key}] = operationStats{lastSuccess: time.Now(), duration: duration, size: size}
+	m.lastFailed[operationKey{operation, key}] = false
+	if operation == backupOperation {
+		m.uploadBytes[metricKey{job: key.job, storage: key.storage}] += size
+		m.lastUpload[metricKey{job: key.job, storage: key.storage}] += size
+	}
+}
+
+func (m *metricsRegistry) failed(operation string, key metricKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[operationKey{operation, key}]++
+	m.lastFailed[operationKey{operation, key}] = true
+}
+
+func (m *metricsRegistry) pruned(job, storage string, deleted int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneDeleted[metricKey{job: job, storage: storage}] += deleted
+}
+
+// lastBackupSuccess returns the time of the last successful backup of each database of a job, on any storage
+func (m *metricsRegistry) lastBackupSuccess() map[metricKey]time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last := map[metricKey]time.Time{}
+	for key, stats := range m.last {
+		jobKey := metricKey{job: key.job, database: key.database}
+		if key.operation == backupOperation && stats.lastSuccess.After(last[jobKey]) {
+			last[jobKey] = stats.lastSuccess
+		}
+	}
+	return last
+}
+
+// samples returns the samples of the given job, or of all jobs when job is empty
+func (m *metricsRegistry) samples(job string) []metricSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var samples []metricSample
+	add := func(name, kind, help string, key metricKey, value float64) {
+		if job != "" && key.job != job {
+			return
+		}
+		samples = append(samples, metricSample{name: name, kind: kind, help: help, labels: key.labels(), value: value})
+	}
+	for _, operation := range []string{backupOperation, restoreOperation, migrateOperation} {
+		keys := operationKeys(m.last, operation)
+		for _, key := range keys {
+			add(fmt.Sprintf("pgbkup_%s_last_success_timestamp_seconds", operation), "gauge",
+				fmt.Sprintf("Unix time of the last successful %s.", operation), key, float64(m.last[operationKey{operation, key}].lastSuccess.Unix()))
+		}
+		for _, key := range keys {
+			add(fmt.Sprintf("pgbkup_%s_last_duration_seconds", operation), "gauge",
+				fmt.Sprintf("Duration of the last successful %s.", operation), key, m.last[operationKey{operation, key}].duration.Seconds())
+		}
+		if operation == backupOperation {
+			for _, key := range keys {
+				add("pgbkup_backup_last_size_bytes", "gauge", "Size of the last successful backup.", key, float64(m.last[operationKey{operation, key}].size))
+			}
+		}
+		if operation == migrateOperation {
+			for _, key := range keys {
+				add("pgbkup_migrate_last_size_bytes", "gauge", "Size of the dump of the last successful migration.", key, float64(m.last[operationKey{operation, key}].size))
+			}
+		}
+		for _, key := range operationKeys(m.failures, operation) {
+			add(fmt.Sprintf("pgbkup_%s_failures_total", operation), "counter",
+				fmt.Sprintf("Number of failed %ss.", operation), key, float64(m.failures[operationKey{operation, key}]))
+		}
+		for _, key := range operationKeys(m.lastFailed, operation) {
+			failed := 0.0
+			if m.lastFailed[operationKey{operation, key}] {
+				failed = 1
+			}
+			add(fmt.Sprintf("pgbkup_%s_last_run_failed", operation), "gauge",
+				fmt.Sprintf("1 when the last %s failed, 0 when it succeeded.", operation), key, failed)
+		}
+	}
+	for _, key := range sortedKeys(m.pruneDeleted) {
+		add("pgbkup_prune_deleted_total", "counter", "Number of backup files deleted by the retention policy.", key, float64(m.pruneDeleted[key]))
+	}
+	for _, key := range sortedKeys(m.uploadBytes) {
+		add("pgbkup_upload_bytes_total", "counter", "Number of bytes uploaded to the storage.", key, float64(m.uploadBytes[key]))
+	}
+	for _, key := range sortedKeys(m.lastUpload) {
+		add("pgbkup_backup_last_upload_bytes", "gauge", "Number of bytes uploaded to the storage by the last run of the job.", key, float64(m.lastUpload[key]))
+	}
+	return samples
+}
+
+// write writes the metrics in the Prometheus text format
+func (m *metricsRegistry) write(w io.Writer, sc *scheduler) {
+	samples := m.samples("")
+	if sc != nil {
+		for _, entry := range sc.entries() {
+			if entry.NextRun.IsZero() {
+				continue
+			}
+			samples = append(samples, metricSample{
+				name:   "pgbkup_next_scheduled_run_timestamp_seconds",
+				kind:   "gauge",
+				help:   "Unix time of the next scheduled run of a job.",
+				labels: [][2]string{{"job_name", entry.Name}},
+				value:  float64(entry.NextRun.Unix()),
+			})
+		}
+	}
+	writePrometheus(w, samples)
+}
+
+// writePrometheus writes samples in the Prometheus text format, samples of a metric must be contiguous
+func writePrometheus(w io.Writer, samples []metricSample) {
+	previous := ""
+	for _, sample := range samples {
+		if sample.name != previous {
+			_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", sample.name, sample.help, sample.name, sample.kind)
+			previous = sample.name
+		}
+		pairs := make([]string, 0, len(sample.labels))
+		for _, label := range sample.labels {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label[0], labelEscaper.Replace(label[1])))
+		}
+		_, _ = fmt.Fprintf(w, "%s{%s} %s\n", sample.name, strings.Join(pairs, ","), formatValue(sample.value))
+	}
+}
+
+// labels returns the labels of the key, empty values are omitted
+func (k metricKey) labels() [][2]string {
+	var labels [][2]string
+	for _, label := range [][2]string{{"job_name", k.job}, {"database", k.database}, {"storage", k.storage}} {
+		if label[1] != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+func (k metricKey) less(other metricKey) bool {
+	if k.job != other.job {
+		return k.job < other.job
+	}
+	if k.database != other.database {
+		return k.database < other.database
+	}
+	return k.storage < other.storage
+}
+
+// operationKeys returns the sorted keys of an operation
+func operationKeys[V any](m map[operationKey]V, operation string) []metricKey {
+	var keys []metricKey
+	for key := range m {
+		if key.operation == operation {
+			keys = append(keys, key.metricKey)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	return keys
+}
+
+func sortedKeys[V any](m map[metricKey]V) []metricKey {
+	keys := make([]metricKey, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	return keys
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// labelEscaper escapes label values as defined by the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// startMetricsServer serves /metrics in scheduled mode
+func startMetricsServer(listen string, sc *scheduler) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.write(w, sc)
+	})
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Info("Starting metrics server", "listen", listen)
+	if err := server.ListenAndServe(); err != nil {
+		logger.Fatal("Error starting metrics server", "error", err)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		last:         map[operationKey]operationStats{},
+		failures:     map[operationKey]int{},
+		pruneDeleted: map[metricKey]int{},
+		uploadBytes:  map[metricKey]int64{},
+		lastFailed:   map[operationKey]bool{},
+		lastUpload:   map[metricKey]int64{},
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []metricSample
+		want    string
+	}{
+		{"header once per metric", []metricSample{
+			{name: "pgbkup_upload_bytes_total", kind: "counter", help: "Bytes.", labels: [][2]string{{"job_name", "a"}}, value: 1},
+			{name: "pgbkup_upload_bytes_total", kind: "counter", help: "Bytes.", labels: [][2]string{{"job_name", "b"}}, value: 2.5},
+		}, "# HELP pgbkup_upload_bytes_total Bytes.\n# TYPE pgbkup_upload_bytes_total counter\n" +
+			"pgbkup_upload_bytes_total{job_name=\"a\"} 1\npgbkup_upload_bytes_total{job_name=\"b\"} 2.5\n"},
+		{"escaped label values", []metricSample{
+			{name: "m", kind: "gauge", help: "H.", labels: [][2]string{{"database", "a\"b\\c\nd"}}, value: 0},
+		}, "# HELP m H.\n# TYPE m gauge\nm{database=\"a\\\"b\\\\c\\nd\"} 0\n"},
+		{"large values are not in exponent form", []metricSample{
+			{name: "m", kind: "gauge", help: "H.", labels: [][2]string{{"job_name", "a"}}, value: 1734660000},
+		}, "# HELP m H.\n# TYPE m gauge\nm{job_name=\"a\"} 1734660000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			writePrometheus(&b, tt.samples)
+			if b.String() != tt.want {
+				t.Errorf("writePrometheus() =\n%s\nwant\n%s", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsLastRun(t *testing.T) {
+	m := newTestRegistry()
+	shop := metricKey{job: "nightly", database: "shop", storage: "s3"}
+	crm := metricKey{job: "nightly", database: "crm", storage: "s3"}
+	m.succeeded(backupOperation, shop, 100, time.Second)
+	m.failed(backupOperation, crm)
+	// The next run resets the uploaded bytes but keeps the counters
+	m.runStarted("nightly")
+	m.succeeded(backupOperation, shop, 40, time.Second)
+	m.succeeded(backupOperation, crm, 60, time.Second)
+	values := map[string]float64{}
+	for _, sample := range m.samples("nightly") {
+		pairs := make([]string, 0, len(sample.labels))
+		for _, label := range sample.labels {
+			pairs = append(pairs, label[1])
+		}
+		values[sample.name+"/"+strings.Join(pairs, "/")] = sample.value
+	}
+	tests := []struct {
+		series string
+		want   float64
+	}{
+		{"pgbkup_backup_last_run_failed/nightly/crm/s3", 0},
+		{"pgbkup_backup_last_run_failed/nightly/shop/s3", 0},
+		{"pgbkup_backup_failures_total/nightly/crm/s3", 1},
+		{"pgbkup_backup_last_upload_bytes/nightly/s3", 100},
+		{"pgbkup_upload_bytes_total/nightly/s3", 200},
+	}
+	for _, tt := range tests {
+		if got, ok := values[tt.series]; !ok || got != tt.want {
+			t.Errorf("%s = %v (present %v), want %v", tt.series, got, ok, tt.want)
+		}
+	}
+}
@@ -29,7 +29,10 @@ import (
 	"fmt"
 	"github.com/jackc/pgx/v5"
 	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
 	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -38,6 +41,10 @@ func StartMigration(cmd *cobra.Command) {
 	logger.Info("Starting database migration task...")
 	all, _ := cmd.Flags().GetBool("all-databases")
 	instance, _ := cmd.Flags().GetBool("entire-instance")
+	masking := initMaskingProfile(utils.GetEnv(cmd, "masking-profile", "MASKING_PROFILE"))
+	if masking != nil && instance {
+		logger.Fatal("Masking profile is not supported when migrating the entire instance")
+	}
 
 	// Get DB config
 	dbConf = initDbConfig(cmd)
@@ -54,73 +61,102 @@ func StartMigration(cmd *cobra.Command) {
 	newDbConfig.dbName = targetDbConf.targetDbName
 	newDbConfig.dbUserName = targetDbConf.targetDbUserName
 	newDbConfig.dbPassword = targetDbConf.targetDbPassword
+	newDbConfig.service = targetDbConf.targetDbService
+	newDbConfig.ssl = targetDbConf.targetDbSsl
+	newDbConfig.params = targetDbConf.targetDbParams
 
+	source, target := dbConf.dbName, newDbConfig.dbName
+	if all {
+		source, target = "all_databases", "all_databases"
+	}
+	op := startOperation(utils.Event{Database: source, TargetDatabase: target, Host: newDbConfig.dbHost}, utils.MigrationSucceeded, utils.MigrationFailed)
+	var rows int64
 	if all {
-		migrateAllDatabases(dbConf, &newDbConfig)
+		rows = migrateAllDatabases(dbConf, &newDbConfig, masking)
 	} else if instance {
-		migrate(dbConf, &newDbConfig, true)
+		rows = migrate(dbConf, &newDbConfig, true, nil)
 
 	} else {
-		migrate(dbConf, &newDbConfig, false)
+		rows = migrate(dbConf, &newDbConfig, false, masking)
 	}
 	logger.Info("Database migration process finished successfully.")
+	op.succeeded(rows)
 
 }
 
-func migrate(dbConf, targetDb *dbConfig, allInstance bool) {
+// migrate backs up the source database and restores it into the target database, returns the restored rows
+func migrate(dbConf, targetDb *dbConfig, allInstance bool, masking *MaskingProfile) int64 {
 	// Generate a timestamped backup file name
 	backupFileName := fmt.Sprintf("%s_%s.sql", dbConf.dbName, time.Now().Format("20060102_150405"))
-	conf := &RestoreConfig{file: backupFileName}
+	job := "migrate_" + dbConf.dbName
+	setOperationMetric(migrateOperation, metricKey{job: job, database: dbConf.dbName})
+	workDir, err := newWorkDir()
+	if err != nil {
+		failOperation("Error creating working directory", "error", err)
+	}
+	defer removeWorkDir(workDir)
+	conf := &RestoreConfig{file: backupFileName, workDir: workDir}
 
 	backupConfig := &BackupConfig{
 		backupFileName:     backupFileName,
+		run:                &backupRun{database: dbConf.dbName, workDir: workDir, startTime: time.Now()},
 		all:                allInstance,
 		allInOne:           allInstance,
 		disableCompression: true,
+		masking:            masking,
 	}
 	// Backup the source database
 	logger.Info(fmt.Sprintf("Starting backup for database [%s]...", dbConf.dbName))
-	err := BackupDatabase(dbConf, backupConfig)
+	err = BackupDatabase(dbConf, backupConfig)
 	if err != nil {
-		logger.Fatal("Failed to back up database", "name", dbConf.dbName, "error", err)
+		setOperationOutput(backupConfig.run.stderr.String())
+		failOperation("Failed to back up database", "name", dbConf.dbName, "error", err)
 	}
 
 	logger.Info("Backup completed", "filename", backupFileName)
+	var size int64
+	if info, err := os.Stat(filepath.Join(workDir, backupFileName)); err == nil {
+		size = info.Size()
+	}
 
 	// Restore the backup into the target database
 	logger.Info(fmt.Sprintf("Starting restoration: [%s] → [%s]...", dbConf.dbName, targetDb.dbName))
 	RestoreDatabase(targetDb, conf)
 	logger.Info(fmt.Sprintf("Restoration completed: [%s] successfully migrated to [%s]", dbConf.dbName, targetDb.dbName))
-
+	metrics.succeeded(migrateOperation, metricKey{job: job, database: dbConf.dbName}, size, time.Since(backupConfig.run.startTime))
+	pushMetrics(job)
+	return conf.rows
 }
 
-func migrateAllDatabases(dbConf, targetDb *dbConfig) {
+func migrateAllDatabases(dbConf, targetDb *dbConfig, masking *MaskingProfile) int64 {
 	databases, err := listDatabases(*dbConf)
 	if err != nil {
-		logger.Fatal("Error listing databases", "error", err)
+		failOperation("Error listing databases", "error", err)
 	}
 
+	var rows int64
 	for _, dbName := range databases {
 		dbConf.dbName = dbName
 		targetDb.dbName = dbName
 
 		exists, err := targetDb.databaseExists()
 		if err != nil {
-			logger.Fatal("Error checking database existence", "error", err)
+			failOperation("Error checking database existence", "error", err)
 		}
 
 		if !exists {
 			logger.Info(fmt.Sprintf("Database [%s] does not exist, creating...", dbName))
 			if err := targetDb.createDatabase(); err != nil {
-				logger.Fatal("Error creating database", "error", err)
+				failOperation("Error creating database", "error", err)
 			}
 		} else {
 			logger.Info(fmt.Sprintf("Database [%s] already exists, skipping creation...", dbName))
 		}
 
-		migrate(dbConf, targetDb, false)
+		rows += migrate(dbConf, targetDb, false, masking)
 	}
 	logger.Info("All databases have been migrated.")
+	return rows
 }
 
 func (db *dbConfig) databaseExists() (bool, error) {
@@ -170,6 +206,5 @@ func (db *dbConfig) createDatabase() error {
 }
 
 func dbConnect(db *dbConfig) (*pgx.Conn, error) {
-	connString := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", db.dbUserName, db.dbPassword, db.dbHost, db.dbPort, db.dbName)
-	return pgx.Connect(context.Background(), connString)
+	return pgx.Connect(context.Background(), db.connString())
 }
@@ -0,0 +1,132 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"fmt"
+	goutils "github.com/jkaninda/go-utils"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// operation is the restore or migration run by the process, its failure is notified before exiting
+type operation struct {
+	event   utils.Event
+	success utils.EventType
+	failure utils.EventType
+	start   time.Time
+	// output is the output of the failed command, logMark the position of the log output at the start
+	output  string
+	logMark int64
+	// metric is the series marked as failed by failOperation
+	metric *operationKey
+}
+
+// currentOperation is set by the restore and migrate commands, which run one operation per process
+var currentOperation *operation
+
+// startOperation starts the operation notified on success and on failOperation
+func startOperation(event utils.Event, success, failure utils.EventType) *operation {
+	currentOperation = &operation{event: event, success: success, failure: failure, start: time.Now(), logMark: utils.LogMark()}
+	return currentOperation
+}
+
+// setOperationOutput keeps the output of a failed command, attached to the failure notification
+func setOperationOutput(output string) {
+	if currentOperation != nil {
+		currentOperation.output = output
+	}
+}
+
+// setOperationMetric sets the series of the metrics updated when the running operation fails
+func setOperationMetric(operation string, key metricKey) {
+	if currentOperation != nil {
+		currentOperation.metric = &operationKey{operation, key}
+	}
+}
+
+// succeeded notifies the success of the operation
+func (op *operation) succeeded(rows int64) {
+	currentOperation = nil
+	event := op.event
+	event.Type = op.success
+	event.Rows = rows
+	event.Duration = goutils.FormatDuration(time.Since(op.start), 0)
+	utils.Notify(&event)
+}
+
+// failOperation notifies the failure of the running restore or migration, then exits
+func failOperation(msg string, args ...any) {
+	if op := currentOperation; op != nil {
+		currentOperation = nil
+		event := op.event
+		event.Type = op.failure
+		event.Error = errorMessage(msg, args...)
+		event.Duration = goutils.FormatDuration(time.Since(op.start), 0)
+		event.Attachments = failureAttachments(op.output, utils.LogsSince(op.logMark))
+		utils.Notify(&event)
+		if op.metric != nil {
+			metrics.failed(op.metric.operation, op.metric.metricKey)
+			pushMetrics(op.metric.job)
+		}
+	}
+	logger.Fatal(msg, args...)
+}
+
+// maxErrorLength bounds the error of a notification, psql output can be very long
+const maxErrorLength = 4000
+
+// errorMessage formats a log message and its key-value pairs, keeping the end of long messages
+func errorMessage(msg string, args ...any) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		_, _ = fmt.Fprintf(&b, ", %v: %v", args[i], args[i+1])
+	}
+	message := b.String()
+	if len(message) > maxErrorLength {
+		message = "..." + strings.ToValidUTF8(message[len(message)-maxErrorLength:], "")
+	}
+	return message
+}
+
+// rowsPattern matches the command tags printed by psql for COPY and INSERT statements
+var rowsPattern = regexp.MustCompile(`(?m)^(?:COPY|INSERT \d+) (\d+)$`)
+
+// restoredRows returns the number of rows restored by psql
+func restoredRows(output string) int64 {
+	var rows int64
+	for _, match := range rowsPattern.FindAllStringSubmatch(output, -1) {
+		n, err := strconv.ParseInt(match[1], 10, 64)
+		if err == nil {
+			rows += n
+		}
+	}
+	return rows
+}
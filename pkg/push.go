@@ -0,0 +1,138 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdSent holds the last counter values sent to StatsD, counters are sent as increments
+var statsdSent = struct {
+	mu     sync.Mutex
+	values map[string]float64
+}{values: map[string]float64{}}
+
+// pushMetrics pushes the metrics of a job to the Pushgateway and StatsD endpoints when configured,
+// a push error is logged and never fails the run
+func pushMetrics(job string) {
+	samples := metrics.samples(job)
+	if len(samples) == 0 {
+		return
+	}
+	if gateway := os.Getenv("PUSHGATEWAY_URL"); gateway != "" {
+		if err := pushToGateway(gateway, job, samples); err != nil {
+			logger.Error("Error pushing metrics to Pushgateway", "job", job, "error", err)
+		} else {
+			logger.Info("Metrics pushed to Pushgateway", "job", job)
+		}
+	}
+	if address := os.Getenv("STATSD_ADDRESS"); address != "" {
+		if err := pushToStatsd(address, samples); err != nil {
+			logger.Error("Error pushing metrics to StatsD", "job", job, "error", err)
+		} else {
+			logger.Info("Metrics pushed to StatsD", "job", job)
+		}
+	}
+}
+
+// pushToGateway pushes the metrics of the job group, grouped by PUSHGATEWAY_JOB and job_name,
+// metrics missing from the push, e.g. the last success of a failed run, are kept
+func pushToGateway(gateway, job string, samples []metricSample) error {
+	var body bytes.Buffer
+	writePrometheus(&body, samples)
+	endpoint := fmt.Sprintf("%s/metrics/job/%s/job_name/%s", strings.TrimRight(gateway, "/"),
+		groupingValue(utils.EnvWithDefault("PUSHGATEWAY_JOB", "pg-bkup")), groupingValue(job))
+	req, err := http.NewRequest(http.MethodPost, endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	if username := os.Getenv("PUSHGATEWAY_USERNAME"); username != "" {
+		req.SetBasicAuth(username, utils.Env("PUSHGATEWAY_PASSWORD"))
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// groupingValue encodes a grouping label value of the Pushgateway URL
+func groupingValue(value string) string {
+	if strings.Contains(value, "/") {
+		return base64.RawURLEncoding.EncodeToString([]byte(value)) + "@base64"
+	}
+	return url.PathEscape(value)
+}
+
+// pushToStatsd sends the samples to a StatsD server with DogStatsD tags
+func pushToStatsd(address string, samples []metricSample) error {
+	conn, err := net.DialTimeout("udp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	statsdSent.mu.Lock()
+	defer statsdSent.mu.Unlock()
+	for _, sample := range samples {
+		tags := make([]string, 0, len(sample.labels))
+		for _, label := range sample.labels {
+			tags = append(tags, label[0]+":"+label[1])
+		}
+		value, kind := sample.value, "g"
+		if sample.kind == "counter" {
+			series := sample.name + "|" + strings.Join(tags, ",")
+			value, kind = sample.value-statsdSent.values[series], "c"
+			statsdSent.values[series] = sample.value
+			if value == 0 {
+				continue
+			}
+		}
+		line := fmt.Sprintf("%s:%s|%s", sample.name, formatValue(value), kind)
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		if _, err = conn.Write([]byte(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -42,18 +42,22 @@ func sshBackup(db *dbConfig, config *BackupConfig) {
 	// Backup database
 	err := BackupDatabase(db, config)
 	if err != nil {
-		recoverMode(err, "Error backing up database")
+		recoverMode(config, db.dbName, err, "Error backing up database")
 		return
 	}
 	finalFileName := config.backupFileName
 	if config.encryption {
-		encryptBackup(config)
+		if err := encryptBackup(config); err != nil {
+			recoverMode(config, db.dbName, err, "Error encrypting backup")
+			return
+		}
 		finalFileName = fmt.Sprintf("%s.%s", config.backupFileName, "gpg")
 	}
 	logger.Info("Uploading backup archive to remote storage ... ")
 	sshConfig, err := loadSSHConfig()
 	if err != nil {
-		logger.Fatal("Error loading ssh config", "error", err)
+		recoverMode(config, db.dbName, err, "Error loading ssh config")
+		return
 	}
 
 	sshStorage, err := ssh.NewStorage(ssh.Config{
@@ -63,52 +67,47 @@ func sshBackup(db *dbConfig, config *BackupConfig) {
 		Password:     sshConfig.password,
 		IdentifyFile: sshConfig.identifyFile,
 		RemotePath:   config.remotePath,
-		LocalPath:    tmpPath,
+		LocalPath:    config.run.workDir,
 	})
 	if err != nil {
-		logger.Fatal("Error creating SSH storage", "error", err)
+		recoverMode(config, db.dbName, err, "Error creating SSH storage")
+		return
 	}
 	err = sshStorage.Copy(finalFileName)
 	if err != nil {
-		logger.Fatal("Error copying backup file", "error", err)
+		recoverMode(config, db.dbName, err, "Error copying backup file")
+		return
 	}
 	// Get backup info
-	fileInfo, err := os.Stat(filepath.Join(tmpPath, finalFileName))
+	fileInfo, err := os.Stat(filepath.Join(config.run.workDir, finalFileName))
 	if err != nil {
 		logger.Error("Error get backup info", "error", err)
 	}
-	backupSize = fileInfo.Size()
+	backupSize := fileInfo.Size()
+	config.run.checksum = fileChecksum(filepath.Join(config.run.workDir, finalFileName))
 	logger.Info("Backup saved", "location", filepath.Join(config.remotePath, finalFileName))
 	logger.Info("Uploading backup archive to SFTP storage ... done", "filename", finalFileName, "size", goutils.ConvertBytes(uint64(backupSize)))
 
 	// Delete backup file from tmp folder
-	err = utils.DeleteFile(filepath.Join(tmpPath, finalFileName))
+	err = utils.DeleteFile(filepath.Join(config.run.workDir, finalFileName))
 	if err != nil {
 		logger.Error("Error deleting file", "error", err)
 
 	}
 	if config.prune {
-		err := sshStorage.Prune(config.backupRetention)
+		err := pruneBackups(sshStorage, config)
 		if err != nil {
-			logger.Fatal(fmt.Sprintf("Error deleting old backup from %s storage: %s ", config.storage, err))
+			logger.Error("Error deleting old backups, the backup has been completed", "storage", config.storage, "error", err)
 		}
 
 	}
-	duration := goutils.FormatDuration(time.Since(startTime), 0)
+	duration := goutils.FormatDuration(time.Since(config.run.startTime), 0)
 	logger.Info("Backup file uploaded to  Remote storage", "file", finalFileName, "destination", storagePath)
 	logger.Info("Backup completed", "file", finalFileName, "size", goutils.ConvertBytes(uint64(backupSize)), "duration", duration)
 
+	config.run.completed(finalFileName, filepath.Join(config.remotePath, finalFileName), backupSize)
 	// Send notification
-	utils.NotifySuccess(&utils.NotificationData{
-		File:           finalFileName,
-		BackupSize:     goutils.ConvertBytes(uint64(backupSize)),
-		Database:       db.dbName,
-		Storage:        string(config.storage),
-		BackupLocation: filepath.Join(config.remotePath, finalFileName),
-		Duration:       duration,
-	})
-	// Delete temp
-	deleteTemp()
+	notifyBackupSucceeded(db, config, duration)
 	logger.Info(fmt.Sprintf("The backup of the %s database has been completed in %s", db.dbName, duration))
 
 }
@@ -116,7 +115,7 @@ func remoteRestore(db *dbConfig, conf *RestoreConfig) {
 	logger.Info("Restore database from remote server")
 	sshConfig, err := loadSSHConfig()
 	if err != nil {
-		logger.Fatal("Error loading ssh config", "error", err)
+		failOperation("Error loading ssh config", "error", err)
 	}
 
 	sshStorage, err := ssh.NewStorage(ssh.Config{
@@ -126,14 +125,20 @@ func remoteRestore(db *dbConfig, conf *RestoreConfig) {
 		Password:     sshConfig.password,
 		IdentifyFile: sshConfig.identifyFile,
 		RemotePath:   conf.remotePath,
-		LocalPath:    tmpPath,
+		LocalPath:    conf.workDir,
 	})
 	if err != nil {
-		logger.Fatal("Error creating SSH storage", "error", err)
+		failOperation("Error creating SSH storage", "error", err)
 	}
 	err = sshStorage.CopyFrom(conf.file)
 	if err != nil {
-		logger.Fatal("Error uploading backup file", "error", err)
+		failOperation("Error uploading backup file", "error", err)
+	}
+	if conf.globalsFile != "" {
+		err = sshStorage.CopyFrom(conf.globalsFile)
+		if err != nil {
+			failOperation("Error downloading globals file", "error", err)
+		}
 	}
 	RestoreDatabase(db, conf)
 }
@@ -146,14 +151,20 @@ func ftpRestore(db *dbConfig, conf *RestoreConfig) {
 		User:       ftpConfig.user,
 		Password:   ftpConfig.password,
 		RemotePath: conf.remotePath,
-		LocalPath:  tmpPath,
+		LocalPath:  conf.workDir,
 	})
 	if err != nil {
-		logger.Fatal("Error creating SSH storage", "error", err)
+		failOperation("Error creating SSH storage", "error", err)
 	}
 	err = ftpStorage.CopyFrom(conf.file)
 	if err != nil {
-		logger.Fatal("Error uploading backup file", "error", err)
+		failOperation("Error uploading backup file", "error", err)
+	}
+	if conf.globalsFile != "" {
+		err = ftpStorage.CopyFrom(conf.globalsFile)
+		if err != nil {
+			failOperation("Error downloading globals file", "error", err)
+		}
 	}
 	RestoreDatabase(db, conf)
 }
@@ -163,12 +174,15 @@ func ftpBackup(db *dbConfig, config *BackupConfig) {
 	// Backup database
 	err := BackupDatabase(db, config)
 	if err != nil {
-		recoverMode(err, "Error backing up database")
+		recoverMode(config, db.dbName, err, "Error backing up database")
 		return
 	}
 	finalFileName := config.backupFileName
 	if config.encryption {
-		encryptBackup(config)
+		if err := encryptBackup(config); err != nil {
+			recoverMode(config, db.dbName, err, "Error encrypting backup")
+			return
+		}
 		finalFileName = fmt.Sprintf("%s.%s", config.backupFileName, "gpg")
 	}
 	logger.Info("Uploading backup archive to the remote FTP server ... ")
@@ -180,49 +194,44 @@ func ftpBackup(db *dbConfig, config *BackupConfig) {
 		User:       ftpConfig.user,
 		Password:   ftpConfig.password,
 		RemotePath: config.remotePath,
-		LocalPath:  tmpPath,
+		LocalPath:  config.run.workDir,
 	})
 	if err != nil {
-		logger.Fatal("Error creating SSH storage", "error", err)
+		recoverMode(config, db.dbName, err, "Error creating SSH storage")
+		return
 	}
 	err = ftpStorage.Copy(finalFileName)
 	if err != nil {
-		logger.Fatal("Error uploading backup file", "error", err)
+		recoverMode(config, db.dbName, err, "Error uploading backup file")
+		return
 	}
 	logger.Info(fmt.Sprintf("Backup saved in %s", filepath.Join(config.remotePath, finalFileName)))
 	// Get backup info
-	fileInfo, err := os.Stat(filepath.Join(tmpPath, finalFileName))
+	fileInfo, err := os.Stat(filepath.Join(config.run.workDir, finalFileName))
 	if err != nil {
 		logger.Error("Error getting backup info", "error", err)
 	}
-	backupSize = fileInfo.Size()
+	backupSize := fileInfo.Size()
+	config.run.checksum = fileChecksum(filepath.Join(config.run.workDir, finalFileName))
 	// Delete backup file from tmp folder
-	err = utils.DeleteFile(filepath.Join(tmpPath, finalFileName))
+	err = utils.DeleteFile(filepath.Join(config.run.workDir, finalFileName))
 	if err != nil {
 		logger.Error("Error deleting file", "error", err)
 
 	}
 	if config.prune {
-		err := ftpStorage.Prune(config.backupRetention)
+		err := pruneBackups(ftpStorage, config)
 		if err != nil {
-			logger.Fatal(fmt.Sprintf("Error deleting old backup from %s storage: %s ", config.storage, err))
+			logger.Error("Error deleting old backups, the backup has been completed", "storage", config.storage, "error", err)
 		}
 
 	}
-	duration := goutils.FormatDuration(time.Since(startTime), 0)
+	duration := goutils.FormatDuration(time.Since(config.run.startTime), 0)
 	logger.Info("Backup file uploaded to  FTP storage", "file", finalFileName, "destination", storagePath)
 	logger.Info("Backup completed", "file", finalFileName, "size", goutils.ConvertBytes(uint64(backupSize)), "duration", duration)
 
+	config.run.completed(finalFileName, filepath.Join(config.remotePath, finalFileName), backupSize)
 	// Send notification
-	utils.NotifySuccess(&utils.NotificationData{
-		File:           finalFileName,
-		BackupSize:     goutils.ConvertBytes(uint64(backupSize)),
-		Database:       db.dbName,
-		Storage:        string(config.storage),
-		BackupLocation: filepath.Join(config.remotePath, finalFileName),
-		Duration:       duration,
-	})
-	// Delete temp
-	deleteTemp()
+	notifyBackupSucceeded(db, config, duration)
 	logger.Info(fmt.Sprintf("The backup of the %s database has been completed in %s", db.dbName, duration))
 }
@@ -34,13 +34,47 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 func StartRestore(cmd *cobra.Command) {
 	intro()
 	dbConf = initDbConfig(cmd)
 	restoreConf := initRestoreConfig(cmd)
+	if latest, _ := cmd.Flags().GetBool("latest"); latest {
+		if restoreConf.file != "" {
+			logger.Fatal("--latest cannot be combined with --file")
+		}
+		record, err := latestBackup(dbConf.dbName, restoreConf.storage)
+		if err != nil {
+			logger.Fatal("Error finding the latest backup", "error", err)
+		}
+		logger.Info("Restoring the latest backup", "file", record.File, "time", record.Time.Local().Format(timeFormat))
+		restoreConf.file = record.File
+		if restoreConf.storage == LocalStorage || restoreConf.storage == "" {
+			restoreConf.file = record.Location
+		} else if restoreConf.remotePath == "" {
+			restoreConf.remotePath = filepath.Dir(record.Location)
+		}
+	}
+	workDir, err := newWorkDir()
+	if err != nil {
+		failOperation("Error creating working directory", "error", err)
+	}
+	defer removeWorkDir(workDir)
+	restoreConf.workDir = workDir
+	op := startOperation(utils.Event{
+		Database:       dbConf.dbName,
+		Storage:        string(restoreConf.storage),
+		SourceFile:     restoreConf.file,
+		TargetDatabase: dbConf.dbName,
+		Host:           dbConf.dbHost,
+	}, utils.RestoreSucceeded, utils.RestoreFailed)
+	job := "restore_" + dbConf.dbName
+	setOperationMetric(restoreOperation, metricKey{job: job, database: dbConf.dbName, storage: string(restoreConf.storage)})
 
+	start := time.Now()
 	switch restoreConf.storage {
 	case LocalStorage:
 		localRestore(dbConf, restoreConf)
@@ -55,6 +89,9 @@ func StartRestore(cmd *cobra.Command) {
 	default:
 		localRestore(dbConf, restoreConf)
 	}
+	metrics.succeeded(restoreOperation, metricKey{job: job, database: dbConf.dbName, storage: string(restoreConf.storage)}, 0, time.Since(start))
+	pushMetrics(job)
+	op.succeeded(restoreConf.rows)
 }
 func localRestore(dbConf *dbConfig, restoreConf *RestoreConfig) {
 	logger.Info("Restore database from local")
@@ -66,11 +103,18 @@ func localRestore(dbConf *dbConfig, restoreConf *RestoreConfig) {
 	}
 	localStorage := local.NewStorage(local.Config{
 		RemotePath: basePath,
-		LocalPath:  tmpPath,
+		LocalPath:  restoreConf.workDir,
 	})
 	err := localStorage.CopyFrom(fileName)
 	if err != nil {
-		logger.Fatal("Error copying backup file", "error", err)
+		failOperation("Error copying backup file", "error", err)
+	}
+	if restoreConf.globalsFile != "" {
+		restoreConf.globalsFile = filepath.Base(restoreConf.globalsFile)
+		err = localStorage.CopyFrom(restoreConf.globalsFile)
+		if err != nil {
+			failOperation("Error copying globals file", "error", err)
+		}
 	}
 	RestoreDatabase(dbConf, restoreConf)
 
@@ -79,13 +123,13 @@ func localRestore(dbConf *dbConfig, restoreConf *RestoreConfig) {
 // RestoreDatabase restores the database from a backup file
 func RestoreDatabase(db *dbConfig, conf *RestoreConfig) {
 	if conf.file == "" {
-		logger.Fatal("Error, file required")
+		failOperation("Error, file required")
 	}
 
-	filePath := filepath.Join(tmpPath, conf.file)
+	filePath := filepath.Join(conf.workDir, conf.file)
 	rFile, err := os.ReadFile(filePath)
 	if err != nil {
-		logger.Fatal("Error reading backup file", "error", err)
+		failOperation("Error reading backup file", "error", err)
 	}
 
 	extension := filepath.Ext(filePath)
@@ -95,17 +139,57 @@ func RestoreDatabase(db *dbConfig, conf *RestoreConfig) {
 		decryptBackup(conf, rFile, outputFile)
 	}
 
-	restorationFile := filepath.Join(tmpPath, conf.file)
+	restorationFile := filepath.Join(conf.workDir, conf.file)
 	if !utils.FileExists(restorationFile) {
-		logger.Fatal("File not found", "file", restorationFile)
+		failOperation("File not found", "file", restorationFile)
+	}
+
+	if conf.verifyOnly {
+		if extension == ".gpg" {
+			restorationFile = outputFile
+		}
+		verifyBackupFile(conf, filePath, restorationFile)
+		return
 	}
 
 	if err := testDatabaseConnection(db); err != nil {
-		logger.Fatal("Error connecting to the database", "error", err)
+		failOperation("Error connecting to the database", "error", err)
+	}
+
+	if conf.globalsFile != "" {
+		restoreGlobals(db, conf)
 	}
 
 	logger.Info("Restoring database...")
-	restoreDatabaseFile(db, restorationFile)
+	conf.rows += restoreDatabaseFile(db, restorationFile)
+}
+
+// restoreGlobals applies roles, grants and tablespaces before the database is restored
+func restoreGlobals(db *dbConfig, conf *RestoreConfig) {
+	filePath := filepath.Join(conf.workDir, conf.globalsFile)
+	if filepath.Ext(filePath) == ".gpg" {
+		rFile, err := os.ReadFile(filePath)
+		if err != nil {
+			failOperation("Error reading globals file", "error", err)
+		}
+		globalsConf := *conf
+		globalsConf.file = conf.globalsFile
+		decryptBackup(&globalsConf, rFile, RemoveLastExtension(filePath))
+		filePath = RemoveLastExtension(filePath)
+	}
+	if !utils.FileExists(filePath) {
+		failOperation("File not found", "file", filePath)
+	}
+	// Globals are cluster-wide, apply them through the maintenance database
+	adminDb := *db
+	adminDb.dbName = "postgres"
+	logger.Info("Restoring roles, grants and tablespaces...")
+	output, err := runRestoreCommand(&adminDb, filePath)
+	if err != nil {
+		setOperationOutput(output)
+		failOperation(fmt.Sprintf("Error restoring globals: %v\nOutput: %s", err, output))
+	}
+	logger.Info("Globals have been restored successfully.")
 }
 
 func decryptBackup(conf *RestoreConfig, rFile []byte, outputFile string) {
@@ -113,42 +197,61 @@ func decryptBackup(conf *RestoreConfig, rFile []byte, outputFile string) {
 		logger.Info("Decrypting backup using private key...")
 		prKey, err := os.ReadFile(conf.privateKey)
 		if err != nil {
-			logger.Fatal("Error reading private key", "error", err)
+			failOperation("Error reading private key", "error", err)
 		}
 		if err := encryptor.DecryptWithPrivateKey(rFile, outputFile, prKey, conf.passphrase); err != nil {
-			logger.Fatal("Error decrypting backup", "error", err)
+			failOperation("Error decrypting backup", "error", err)
 		}
 	} else {
 		if conf.passphrase == "" {
-			logger.Fatal("Passphrase or private key required for GPG file.")
+			failOperation("Passphrase or private key required for GPG file.")
 		}
 		logger.Info("Decrypting backup using passphrase...")
 		if err := encryptor.Decrypt(rFile, outputFile, conf.passphrase); err != nil {
-			logger.Fatal("Error decrypting file", "error", err)
+			failOperation("Error decrypting file", "error", err)
 		}
 		conf.file = RemoveLastExtension(conf.file)
 	}
 }
 
-func restoreDatabaseFile(db *dbConfig, restorationFile string) {
+// restoreDatabaseFile restores a SQL file, returns the restored rows
+func restoreDatabaseFile(db *dbConfig, restorationFile string) int64 {
+	output, err := runRestoreCommand(db, restorationFile)
+	if err != nil {
+		setOperationOutput(output)
+		failOperation(fmt.Sprintf("Error restoring database: %v\nOutput: %s", err, output))
+	}
+	rows := restoredRows(output)
+	logger.Info("Database has been restored successfully.", "rows", rows)
+	return rows
+}
+
+// runRestoreCommand pipes a plain or gzip-compressed SQL file into psql
+func runRestoreCommand(db *dbConfig, restorationFile string) (string, error) {
 	extension := filepath.Ext(restorationFile)
 	var cmdStr string
 
+	passFile, removePassFile, err := createPassFile(db)
+	if err != nil {
+		return "", err
+	}
+	defer removePassFile()
+	psqlCmd := "psql -d " + shellQuote(db.clientConnString(passFile))
 	switch extension {
 	case ".gz":
-		cmdStr = "zcat " + restorationFile + " | psql -h " + db.dbHost + " -p " + db.dbPort + " -U " + db.dbUserName + " -v -d " + db.dbName
+		cmdStr = "zcat " + shellQuote(restorationFile) + " | " + psqlCmd
 	case ".sql":
-		cmdStr = "cat " + restorationFile + " | psql -h " + db.dbHost + " -p " + db.dbPort + " -U " + db.dbUserName + " -v -d " + db.dbName
+		cmdStr = "cat " + shellQuote(restorationFile) + " | " + psqlCmd
 	default:
-		logger.Fatal("Unknown file extension", "extension", extension)
+		return "", fmt.Errorf("unknown file extension %s", extension)
 	}
 
 	cmd := exec.Command("sh", "-c", cmdStr)
 	output, err := cmd.CombinedOutput()
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("Error restoring database: %v\nOutput: %s", err, string(output)))
-	}
+	return string(output), err
+}
 
-	logger.Info("Database has been restored successfully.")
-	deleteTemp()
+// shellQuote quotes a value for sh
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
 }
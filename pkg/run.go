@@ -0,0 +1,275 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	goutils "github.com/jkaninda/go-utils"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupRun holds the state of a single backup, each run has its own working directory
+type backupRun struct {
+	job       string
+	database  string
+	storage   string
+	workDir   string
+	startTime time.Time
+	file      string
+	location  string
+	size      int64
+	checksum  string
+	duration  time.Duration
+	err       error
+	// stderr is the error output of the dump command, logMark the position of the log output at the start of the run
+	stderr  bytes.Buffer
+	logMark int64
+}
+
+// activeRuns are the backups in progress, mapped to whether they overlapped another backup
+var activeRuns = struct {
+	sync.Mutex
+	runs map[*backupRun]bool
+}{runs: map[*backupRun]bool{}}
+
+// newBackupRun creates the run and its working directory
+func newBackupRun(database string) (*backupRun, error) {
+	run := &backupRun{database: database, startTime: time.Now(), logMark: utils.LogMark()}
+	activeRuns.Lock()
+	for r := range activeRuns.runs {
+		activeRuns.runs[r] = true
+	}
+	activeRuns.runs[run] = len(activeRuns.runs) > 0
+	activeRuns.Unlock()
+	workDir, err := newWorkDir()
+	if err != nil {
+		return run, err
+	}
+	run.workDir = workDir
+	return run, nil
+}
+
+// tmpDir returns the directory holding the working directories of the runs
+func tmpDir() string {
+	return utils.EnvWithDefault("BACKUP_TMP_DIR", defaultTmpDir)
+}
+
+// newWorkDir creates a unique working directory for a backup, restore or migration
+func newWorkDir() (string, error) {
+	base := tmpDir()
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", base, err)
+	}
+	workDir, err := os.MkdirTemp(base, "run-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create working directory in %s: %w", base, err)
+	}
+	return workDir, nil
+}
+
+// removeWorkDir deletes a working directory and its files
+func removeWorkDir(workDir string) {
+	if err := os.RemoveAll(workDir); err != nil {
+		logger.Error("Error deleting working directory", "path", workDir, "error", err)
+	}
+}
+
+// completed records a successful backup
+func (r *backupRun) completed(file, location string, size int64) {
+	r.file = file
+	r.location = location
+	r.size = size
+	r.duration = time.Since(r.startTime)
+	metrics.succeeded(backupOperation, r.metricKey(), size, r.duration)
+}
+
+func (r *backupRun) metricKey() metricKey {
+	return metricKey{job: r.job, database: r.database, storage: r.storage}
+}
+
+// cleanup removes the working directory of the run
+func (r *backupRun) cleanup() {
+	activeRuns.Lock()
+	delete(activeRuns.runs, r)
+	activeRuns.Unlock()
+	if r.workDir != "" {
+		removeWorkDir(r.workDir)
+	}
+}
+
+// runLog returns the log output of the run. When other backups ran at the same time,
+// only the lines mentioning the database are kept, the others may belong to any backup
+func (r *backupRun) runLog() []byte {
+	activeRuns.Lock()
+	overlapped := activeRuns.runs[r]
+	activeRuns.Unlock()
+	logs := utils.LogsSince(r.logMark)
+	if !overlapped {
+		return logs
+	}
+	pattern := regexp.MustCompile(`(^|[^\w])` + regexp.QuoteMeta(r.database) + `([^\w]|$)`)
+	var lines []string
+	for _, line := range strings.SplitAfter(string(logs), "\n") {
+		if pattern.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// newSlots returns the slots of a job, at most n of its backups run at the same time
+func newSlots(n int) chan struct{} {
+	if n < 1 {
+		n = 1
+	}
+	return make(chan struct{}, n)
+}
+
+// runConcurrently runs count tasks in parallel and waits for all of them,
+// the backups of the tasks wait for a slot of their job, see runBackup
+func runConcurrently(count int, task func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			task(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// failedRuns returns the number of failed runs
+func failedRuns(runs []*backupRun) int {
+	failed := 0
+	for _, run := range runs {
+		if run.err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// exitOnFailure stops the process when a backup of the job failed, unless rescue mode is enabled.
+// It is called once every backup of the job has completed and the job has been reported
+func exitOnFailure(name string, runs []*backupRun) {
+	if failed := failedRuns(runs); failed > 0 && !backupRescueMode {
+		logger.Fatal("Backup job failed", "job", name, "failed", failed)
+	}
+}
+
+// logBackupSummary logs the result of each backup run of a job
+func logBackupSummary(name string, runs []*backupRun, duration time.Duration) {
+	failed := failedRuns(runs)
+	var totalSize int64
+	for _, run := range runs {
+		if run.err != nil {
+			logger.Error("Backup failed", "job", name, "database", run.database, "error", run.err)
+			continue
+		}
+		totalSize += run.size
+		logger.Info("Backup succeeded", "job", name, "database", run.database, "file", run.file,
+			"size", goutils.ConvertBytes(uint64(run.size)), "duration", goutils.FormatDuration(run.duration, 0))
+	}
+	logger.Info("Backup summary", "job", name, "backups", len(runs), "succeeded", len(runs)-failed, "failed", failed,
+		"size", goutils.ConvertBytes(uint64(totalSize)), "duration", goutils.FormatDuration(duration, 0))
+}
+
+// notifyBackupSucceeded sends the notification of the completed run of the backup
+func notifyBackupSucceeded(db *dbConfig, config *BackupConfig, duration string) {
+	if config.globalsOnly {
+		return
+	}
+	run := config.run
+	data := &utils.NotificationData{
+		File:           run.file,
+		BackupSize:     goutils.ConvertBytes(uint64(run.size)),
+		Database:       db.dbName,
+		Storage:        string(config.storage),
+		BackupLocation: run.location,
+		Duration:       duration,
+		Recipients:     config.recipients,
+		Job:            config.jobName,
+		Host:           db.dbHost,
+		ServerVersion:  db.serverVersion,
+		Checksum:       run.checksum,
+	}
+	if config.globals != nil {
+		data.GlobalsLocation = config.globals.location
+	}
+	if config.trigger == triggerSchedule && config.cronExpression != "" {
+		data.NextRun = utils.CronNextTime(config.cronExpression)
+	}
+	utils.NotifySuccess(data)
+}
+
+// notifyDigest sends the summary of the backups of a job to the digest notifiers
+func notifyDigest(name string, runs []*backupRun, duration time.Duration, recipients *utils.Recipients) {
+	event := &utils.Event{
+		Type:       utils.BackupDigest,
+		Job:        name,
+		Duration:   goutils.FormatDuration(duration, 0),
+		Recipients: recipients,
+	}
+	var totalSize int64
+	for _, run := range runs {
+		summary := utils.RunSummary{Database: run.database, Storage: run.storage, File: run.file}
+		if run.err != nil {
+			summary.Error = run.err.Error()
+		} else {
+			totalSize += run.size
+			summary.BackupSize = goutils.ConvertBytes(uint64(run.size))
+			summary.Duration = goutils.FormatDuration(run.duration, 0)
+		}
+		event.Runs = append(event.Runs, summary)
+	}
+	event.BackupSize = goutils.ConvertBytes(uint64(totalSize))
+	utils.Notify(event)
+}
+
+// maxAttachmentSize bounds the command output attached to the failure notifications
+const maxAttachmentSize = 1 << 20
+
+// failureAttachments returns the command output and the log output of a run, attached to the failure emails
+func failureAttachments(output string, logs []byte) []utils.Attachment {
+	var attachments []utils.Attachment
+	if output = strings.TrimSpace(output); output != "" {
+		if len(output) > maxAttachmentSize {
+			output = output[len(output)-maxAttachmentSize:]
+		}
+		attachments = append(attachments, utils.Attachment{Name: "command-output.log", Content: []byte(output)})
+	}
+	if len(logs) > 0 {
+		attachments = append(attachments, utils.Attachment{Name: "run.log", Content: logs})
+	}
+	return attachments
+}
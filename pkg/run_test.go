@@ -0,0 +1,73 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecoverModeKeepsRunning(t *testing.T) {
+	registry := metrics
+	metrics = newTestRegistry()
+	t.Cleanup(func() { metrics = registry })
+	run := &backupRun{job: "nightly", database: "orders", storage: "local", startTime: time.Now()}
+	config := &BackupConfig{storage: LocalStorage, jobName: "nightly", run: run}
+	// Without rescue mode, the failure is recorded and the job decides when to stop
+	recoverMode(config, "orders", errors.New("connection refused"), "Error backing up database")
+	if run.err == nil || run.err.Error() != "Error backing up database: connection refused" {
+		t.Errorf("run.err = %v", run.err)
+	}
+	if got := failedRuns([]*backupRun{run, {database: "users"}}); got != 1 {
+		t.Errorf("failedRuns() = %d, want 1", got)
+	}
+}
+
+func TestRunConcurrentlyWaitsForAllTasks(t *testing.T) {
+	slots := newSlots(2)
+	var running, maxRunning, done atomic.Int32
+	runConcurrently(6, func(i int) {
+		slots <- struct{}{}
+		defer func() { <-slots }()
+		n := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		running.Add(-1)
+		done.Add(1)
+	})
+	if done.Load() != 6 {
+		t.Errorf("%d tasks completed, want 6", done.Load())
+	}
+	if maxRunning.Load() > 2 {
+		t.Errorf("%d tasks ran at the same time, want at most 2", maxRunning.Load())
+	}
+}
@@ -42,12 +42,15 @@ func s3Backup(db *dbConfig, config *BackupConfig) {
 	// Backup database
 	err := BackupDatabase(db, config)
 	if err != nil {
-		recoverMode(err, "Error backing up database")
+		recoverMode(config, db.dbName, err, "Error backing up database")
 		return
 	}
 	finalFileName := config.backupFileName
 	if config.encryption {
-		encryptBackup(config)
+		if err := encryptBackup(config); err != nil {
+			recoverMode(config, db.dbName, err, "Error encrypting backup")
+			return
+		}
 		finalFileName = fmt.Sprintf("%s.%s", config.backupFileName, "gpg")
 	}
 	logger.Info("Uploading backup archive to remote storage S3 ... ")
@@ -65,50 +68,45 @@ func s3Backup(db *dbConfig, config *BackupConfig) {
 		DisableSsl:     awsConfig.disableSsl,
 		ForcePathStyle: awsConfig.forcePathStyle,
 		RemotePath:     config.remotePath,
-		LocalPath:      tmpPath,
+		LocalPath:      config.run.workDir,
 	})
 	if err != nil {
-		logger.Fatal("Error creating s3 storage", "error", err)
+		recoverMode(config, db.dbName, err, "Error creating s3 storage")
+		return
 	}
 	err = s3Storage.Copy(finalFileName)
 	if err != nil {
-		logger.Fatal("Error uploading backup file", "error", err)
+		recoverMode(config, db.dbName, err, "Error uploading backup file")
+		return
 	}
 	// Get backup info
-	fileInfo, err := os.Stat(filepath.Join(tmpPath, finalFileName))
+	fileInfo, err := os.Stat(filepath.Join(config.run.workDir, finalFileName))
 	if err != nil {
 		logger.Error("Error getting backup info", "error", err)
 	}
-	backupSize = fileInfo.Size()
+	backupSize := fileInfo.Size()
+	config.run.checksum = fileChecksum(filepath.Join(config.run.workDir, finalFileName))
 
 	// Delete backup file from tmp folder
-	err = utils.DeleteFile(filepath.Join(tmpPath, config.backupFileName))
+	err = utils.DeleteFile(filepath.Join(config.run.workDir, config.backupFileName))
 	if err != nil {
 		fmt.Println("Error deleting file: ", err)
 
 	}
 	// Delete old backup
 	if config.prune {
-		err := s3Storage.Prune(config.backupRetention)
+		err := pruneBackups(s3Storage, config)
 		if err != nil {
-			logger.Fatal(fmt.Sprintf("Error deleting old backup from %s storage: %s ", config.storage, err))
+			logger.Error("Error deleting old backups, the backup has been completed", "storage", config.storage, "error", err)
 		}
 	}
 
-	duration := goutils.FormatDuration(time.Since(startTime), 2)
+	duration := goutils.FormatDuration(time.Since(config.run.startTime), 2)
 	logger.Info("Backup file uploaded to  S3 storage", "file", finalFileName, "destination", storagePath)
 	logger.Info("Backup completed", "file", finalFileName, "size", goutils.ConvertBytes(uint64(backupSize)), "duration", duration)
+	config.run.completed(finalFileName, filepath.Join(config.remotePath, finalFileName), backupSize)
 	// Send notification
-	utils.NotifySuccess(&utils.NotificationData{
-		File:           finalFileName,
-		BackupSize:     goutils.ConvertBytes(uint64(backupSize)),
-		Database:       db.dbName,
-		Storage:        string(config.storage),
-		BackupLocation: filepath.Join(config.remotePath, finalFileName),
-		Duration:       duration,
-	})
-	// Delete temp
-	deleteTemp()
+	notifyBackupSucceeded(db, config, duration)
 	logger.Info(fmt.Sprintf("The backup of the %s database has been completed in %s", db.dbName, duration))
 
 }
@@ -127,14 +125,20 @@ func s3Restore(db *dbConfig, conf *RestoreConfig) {
 		DisableSsl:     awsConfig.disableSsl,
 		ForcePathStyle: awsConfig.forcePathStyle,
 		RemotePath:     conf.remotePath,
-		LocalPath:      tmpPath,
+		LocalPath:      conf.workDir,
 	})
 	if err != nil {
-		logger.Fatal("Error creating s3 storage", "error", err)
+		failOperation("Error creating s3 storage", "error", err)
 	}
 	err = s3Storage.CopyFrom(conf.file)
 	if err != nil {
-		logger.Fatal("Error download file from S3 storage", "error", err)
+		failOperation("Error download file from S3 storage", "error", err)
+	}
+	if conf.globalsFile != "" {
+		err = s3Storage.CopyFrom(conf.globalsFile)
+		if err != nil {
+			failOperation("Error downloading globals file", "error", err)
+		}
 	}
 	RestoreDatabase(db, conf)
 }
@@ -0,0 +1,330 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"github.com/robfig/cron/v3"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Overlap policies
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+)
+
+// scheduler registers all backup jobs on a single cron instance
+type scheduler struct {
+	cron  *cron.Cron
+	state *schedulerState
+	jobs  []scheduledJob
+}
+
+// scheduledJob references a job registered on the cron instance
+type scheduledJob struct {
+	name       string
+	expression string
+	timezone   string
+	id         cron.EntryID
+}
+
+// scheduleEntry describes the next run of a scheduled job
+type scheduleEntry struct {
+	Name           string     `json:"name"`
+	CronExpression string     `json:"cronExpression"`
+	Timezone       string     `json:"timezone,omitempty"`
+	NextRun        time.Time  `json:"nextRun"`
+	LastRun        *time.Time `json:"lastRun,omitempty"`
+}
+
+// schedulerState persists the last run time of each job
+type schedulerState struct {
+	mu       sync.Mutex
+	file     string
+	LastRun  map[string]time.Time `json:"lastRun"`
+	Watchdog watchdogState        `json:"watchdog"`
+}
+
+// watchdogState persists, for each watched database, when it was first watched and when it was last alerted,
+// so that a restarting container still alerts, and only once
+type watchdogState struct {
+	WatchedSince map[string]time.Time `json:"watchedSince,omitempty"`
+	Alerted      map[string]time.Time `json:"alerted,omitempty"`
+}
+
+// cronLogger forwards cron logs to the application logger
+type cronLogger struct{}
+
+func (cronLogger) Info(msg string, keysAndValues ...interface{}) {
+	logger.Info(fmt.Sprintf("Scheduler: %s", msg), keysAndValues...)
+}
+
+func (cronLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	logger.Error(fmt.Sprintf("Scheduler: %s", msg), append(keysAndValues, "error", err)...)
+}
+
+// newScheduler creates a scheduler, loading the last run times from the state file
+func newScheduler(stateFile string) *scheduler {
+	state := &schedulerState{file: stateFile, LastRun: map[string]time.Time{}}
+	if err := state.load(); err != nil {
+		logger.Warn("Error reading scheduler state file, missed runs will not be detected", "file", stateFile, "error", err)
+	}
+	return &scheduler{
+		cron:  cron.New(cron.WithLogger(cronLogger{})),
+		state: state,
+	}
+}
+
+// initSchedule loads the schedule settings from environment variables
+func initSchedule() Schedule {
+	schedule := Schedule{
+		Timezone:      os.Getenv("BACKUP_TIMEZONE"),
+		Jitter:        os.Getenv("BACKUP_JITTER"),
+		OverlapPolicy: os.Getenv("BACKUP_OVERLAP_POLICY"),
+	}
+	if catchUp, err := strconv.ParseBool(os.Getenv("BACKUP_CATCH_UP")); err == nil {
+		schedule.CatchUp = &catchUp
+	}
+	return schedule
+}
+
+// merge returns the schedule with unset fields taken from defaults
+func (s Schedule) merge(defaults Schedule) Schedule {
+	if s.Timezone == "" {
+		s.Timezone = defaults.Timezone
+	}
+	if s.Jitter == "" {
+		s.Jitter = defaults.Jitter
+	}
+	if s.OverlapPolicy == "" {
+		s.OverlapPolicy = defaults.OverlapPolicy
+	}
+	if s.CatchUp == nil {
+		s.CatchUp = defaults.CatchUp
+	}
+	return s
+}
+
+// spec returns the cron spec including the timezone
+func (s Schedule) spec(expression string) string {
+	if s.Timezone == "" {
+		return expression
+	}
+	return fmt.Sprintf("CRON_TZ=%s %s", s.Timezone, expression)
+}
+
+// validate checks the schedule settings
+func (s Schedule) validate(expression string) error {
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", s.Timezone, err)
+		}
+	}
+	if !utils.IsValidCronExpression(s.spec(expression)) {
+		return fmt.Errorf("cron expression %q is not valid", expression)
+	}
+	if s.Jitter != "" {
+		if _, err := time.ParseDuration(s.Jitter); err != nil {
+			return fmt.Errorf("invalid jitter %q: %w", s.Jitter, err)
+		}
+	}
+	switch s.OverlapPolicy {
+	case "", OverlapSkip, OverlapQueue:
+	default:
+		return fmt.Errorf("unknown overlap policy %q, expected %s or %s", s.OverlapPolicy, OverlapSkip, OverlapQueue)
+	}
+	return nil
+}
+
+// add registers a job, and runs it immediately when catch-up is enabled and the last scheduled run was missed
+func (s *scheduler) add(name, expression string, schedule Schedule, run func()) error {
+	if err := schedule.validate(expression); err != nil {
+		return err
+	}
+	cronSchedule, err := cron.ParseStandard(schedule.spec(expression))
+	if err != nil {
+		return err
+	}
+	var jitter time.Duration
+	if schedule.Jitter != "" {
+		jitter, _ = time.ParseDuration(schedule.Jitter)
+	}
+	job := cron.FuncJob(func() {
+		if jitter > 0 {
+			delay := rand.N(jitter)
+			logger.Info("Delaying backup job", "job", name, "jitter", delay.String())
+			time.Sleep(delay)
+		}
+		startedAt := time.Now()
+		run()
+		s.state.record(name, startedAt)
+		logger.Info("Backup job executed successfully; awaiting next scheduled time", "job", name, "next_time", cronSchedule.Next(time.Now()).Format(timeFormat))
+	})
+	wrapper := cron.SkipIfStillRunning(cronLogger{})
+	if schedule.OverlapPolicy == OverlapQueue {
+		wrapper = cron.DelayIfStillRunning(cronLogger{})
+	}
+	wrapped := cron.NewChain(wrapper).Then(job)
+	id := s.cron.Schedule(cronSchedule, wrapped)
+	s.jobs = append(s.jobs, scheduledJob{name: name, expression: expression, timezone: schedule.Timezone, id: id})
+	logger.Info(fmt.Sprintf("The next scheduled time is: %v", cronSchedule.Next(time.Now()).Format(timeFormat)), "job", name, "cron", expression, "timezone", schedule.Timezone)
+
+	if schedule.CatchUp != nil && *schedule.CatchUp {
+		if lastRun, ok := s.state.lastRun(name); ok && cronSchedule.Next(lastRun).Before(time.Now()) {
+			logger.Warn("Missed scheduled run detected, running backup job now", "job", name, "last_run", lastRun.Format(timeFormat))
+			go wrapped.Run()
+		}
+	}
+	return nil
+}
+
+// entries returns the next and last run times of the scheduled jobs
+func (s *scheduler) entries() []scheduleEntry {
+	entries := make([]scheduleEntry, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		entry := scheduleEntry{
+			Name:           job.name,
+			CronExpression: job.expression,
+			Timezone:       job.timezone,
+			NextRun:        s.cron.Entry(job.id).Next,
+		}
+		if lastRun, ok := s.state.lastRun(job.name); ok {
+			entry.LastRun = &lastRun
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// start starts the scheduler and blocks forever
+func (s *scheduler) start() {
+	s.cron.Start()
+	logger.Info("Backup job started")
+	defer s.cron.Stop()
+	select {}
+}
+
+func (st *schedulerState) load() error {
+	if st.file == "" || !utils.FileExists(st.file) {
+		return nil
+	}
+	buf, err := os.ReadFile(st.file)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(buf, st); err != nil {
+		return err
+	}
+	if st.LastRun == nil {
+		st.LastRun = map[string]time.Time{}
+	}
+	return nil
+}
+
+func (st *schedulerState) lastRun(name string) (time.Time, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	lastRun, ok := st.LastRun[name]
+	return lastRun, ok
+}
+
+// record saves the last run time of a job to the state file
+func (st *schedulerState) record(name string, runAt time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.LastRun[name] = runAt
+	st.save()
+}
+
+// watchedSince returns when the watchdog started watching a database, now for a new database
+func (st *schedulerState) watchedSince(key string, now time.Time) time.Time {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if since, ok := st.Watchdog.WatchedSince[key]; ok {
+		return since
+	}
+	if st.Watchdog.WatchedSince == nil {
+		st.Watchdog.WatchedSince = map[string]time.Time{}
+	}
+	st.Watchdog.WatchedSince[key] = now
+	st.save()
+	return now
+}
+
+// alertedAt returns when the watchdog last alerted for a database
+func (st *schedulerState) alertedAt(key string) (time.Time, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	alertedAt, ok := st.Watchdog.Alerted[key]
+	return alertedAt, ok
+}
+
+// setAlerted records an alert of the watchdog, a zero time clears it
+func (st *schedulerState) setAlerted(key string, alertedAt time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.Watchdog.Alerted[key]; !ok && alertedAt.IsZero() {
+		return
+	}
+	if alertedAt.IsZero() {
+		delete(st.Watchdog.Alerted, key)
+	} else {
+		if st.Watchdog.Alerted == nil {
+			st.Watchdog.Alerted = map[string]time.Time{}
+		}
+		st.Watchdog.Alerted[key] = alertedAt
+	}
+	st.save()
+}
+
+// save writes the state file, the caller holds the lock
+func (st *schedulerState) save() {
+	if st.file == "" {
+		return
+	}
+	buf, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		logger.Error("Error encoding scheduler state", "error", err)
+		return
+	}
+	// Write to a temporary file first, so a crash never leaves a truncated state file
+	tmpFile := filepath.Join(filepath.Dir(st.file), fmt.Sprintf(".%s.tmp", filepath.Base(st.file)))
+	if err = os.WriteFile(tmpFile, buf, 0600); err != nil {
+		logger.Error("Error writing scheduler state file", "file", st.file, "error", err)
+		return
+	}
+	if err = os.Rename(tmpFile, st.file); err != nil {
+		logger.Error("Error writing scheduler state file", "file", st.file, "error", err)
+	}
+}
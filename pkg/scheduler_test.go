@@ -0,0 +1,94 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduleMerge(t *testing.T) {
+	yes, no := true, false
+	defaults := Schedule{Timezone: "Europe/Paris", Jitter: "2m", OverlapPolicy: OverlapQueue, CatchUp: &yes}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		want     Schedule
+	}{
+		{"empty takes defaults", Schedule{}, defaults},
+		{"job values win", Schedule{Timezone: "UTC", Jitter: "30s", OverlapPolicy: OverlapSkip, CatchUp: &no},
+			Schedule{Timezone: "UTC", Jitter: "30s", OverlapPolicy: OverlapSkip, CatchUp: &no}},
+		{"partial", Schedule{Timezone: "UTC"},
+			Schedule{Timezone: "UTC", Jitter: "2m", OverlapPolicy: OverlapQueue, CatchUp: &yes}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.schedule.merge(defaults)
+			if got.Timezone != tt.want.Timezone || got.Jitter != tt.want.Jitter || got.OverlapPolicy != tt.want.OverlapPolicy ||
+				got.CatchUp == nil || *got.CatchUp != *tt.want.CatchUp {
+				t.Errorf("merge() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		schedule   Schedule
+		expression string
+		wantErr    bool
+	}{
+		{"defaults", Schedule{}, "0 1 * * *", false},
+		{"descriptor", Schedule{}, "@daily", false},
+		{"timezone", Schedule{Timezone: "America/New_York"}, "0 1 * * *", false},
+		{"unknown timezone", Schedule{Timezone: "Mars/Olympus"}, "0 1 * * *", true},
+		{"invalid expression", Schedule{}, "0 25 * * *", true},
+		{"invalid expression with timezone", Schedule{Timezone: "UTC"}, "not a cron", true},
+		{"jitter", Schedule{Jitter: "90s"}, "0 1 * * *", false},
+		{"invalid jitter", Schedule{Jitter: "soon"}, "0 1 * * *", true},
+		{"skip policy", Schedule{OverlapPolicy: OverlapSkip}, "0 1 * * *", false},
+		{"queue policy", Schedule{OverlapPolicy: OverlapQueue}, "0 1 * * *", false},
+		{"unknown policy", Schedule{OverlapPolicy: "parallel"}, "0 1 * * *", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.schedule.validate(tt.expression); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchedulerStatePersistsLastRun(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	runAt := time.Date(2024, 12, 20, 2, 0, 0, 0, time.UTC)
+	newScheduler(file).state.record("nightly", runAt)
+	lastRun, ok := newScheduler(file).state.lastRun("nightly")
+	if !ok || !lastRun.Equal(runAt) {
+		t.Errorf("lastRun() = %v, %v, want %v", lastRun, ok, runAt)
+	}
+}
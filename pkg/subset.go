@@ -0,0 +1,401 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jkaninda/logger"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// subsetRoot is a root query of a subset, e.g. `customers where created_at > now() - interval '30 days'`
+type subsetRoot struct {
+	table     string
+	condition string
+}
+
+// foreignKey is a foreign key edge between a child and a parent table
+type foreignKey struct {
+	child         string
+	parent        string
+	childColumns  []string
+	parentColumns []string
+}
+
+// subsetState tracks the rows selected in each table, stored as (tableoid, ctid) in temporary tables
+type subsetState struct {
+	ctx    context.Context
+	tx     pgx.Tx
+	tables map[string]string
+}
+
+var subsetRootRegex = regexp.MustCompile(`(?is)^\s*(\S+)(?:\s+where\s+(.+?))?\s*$`)
+
+// parseSubsetRoots parses the subset root queries
+func parseSubsetRoots(subset []string) ([]subsetRoot, error) {
+	roots := make([]subsetRoot, 0, len(subset))
+	for _, root := range subset {
+		matches := subsetRootRegex.FindStringSubmatch(root)
+		if matches == nil {
+			return nil, fmt.Errorf("invalid subset query %q, expected `table where condition`", root)
+		}
+		schema, name := splitTableName(matches[1])
+		roots = append(roots, subsetRoot{
+			table:     pgx.Identifier{schema, name}.Sanitize(),
+			condition: matches[2],
+		})
+	}
+	return roots, nil
+}
+
+// listForeignKeys reads the foreign keys of the database from the catalog
+func listForeignKeys(ctx context.Context, tx pgx.Tx) ([]foreignKey, error) {
+	query := `SELECT cn.nspname, c.relname, pn.nspname, p.relname,
+	       ARRAY(SELECT a.attname FROM unnest(con.conkey) WITH ORDINALITY k(attnum, ord)
+	             JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum ORDER BY k.ord)::text[],
+	       ARRAY(SELECT a.attname FROM unnest(con.confkey) WITH ORDINALITY k(attnum, ord)
+	             JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.attnum ORDER BY k.ord)::text[]
+	FROM pg_constraint con
+	JOIN pg_class c ON c.oid = con.conrelid
+	JOIN pg_namespace cn ON cn.oid = c.relnamespace
+	JOIN pg_class p ON p.oid = con.confrelid
+	JOIN pg_namespace pn ON pn.oid = p.relnamespace
+	WHERE con.contype = 'f' AND NOT c.relispartition AND NOT p.relispartition`
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list foreign keys: %w", err)
+	}
+	defer rows.Close()
+	var keys []foreignKey
+	for rows.Next() {
+		var (
+			childSchema, childName, parentSchema, parentName string
+			childColumns, parentColumns                      []string
+		)
+		if err := rows.Scan(&childSchema, &childName, &parentSchema, &parentName, &childColumns, &parentColumns); err != nil {
+			return nil, fmt.Errorf("failed to scan foreign key: %w", err)
+		}
+		keys = append(keys, foreignKey{
+			child:         pgx.Identifier{childSchema, childName}.Sanitize(),
+			parent:        pgx.Identifier{parentSchema, parentName}.Sanitize(),
+			childColumns:  sanitizeColumns(childColumns),
+			parentColumns: sanitizeColumns(parentColumns),
+		})
+	}
+	return keys, rows.Err()
+}
+
+func sanitizeColumns(columns []string) []string {
+	sanitized := make([]string, len(columns))
+	for i, column := range columns {
+		sanitized[i] = pgx.Identifier{column}.Sanitize()
+	}
+	return sanitized
+}
+
+// rowsTable returns the temporary table holding the selected rows of a table
+func (s *subsetState) rowsTable(table string) (string, error) {
+	if tmp, ok := s.tables[table]; ok {
+		return tmp, nil
+	}
+	tmp := fmt.Sprintf("pgbkup_subset_%d", len(s.tables))
+	if _, err := s.tx.Exec(s.ctx, fmt.Sprintf("CREATE TEMP TABLE %s (tableoid oid, ctid tid) ON COMMIT DROP", tmp)); err != nil {
+		return "", fmt.Errorf("failed to create temporary table: %w", err)
+	}
+	if _, err := s.tx.Exec(s.ctx, fmt.Sprintf("CREATE INDEX ON %s (tableoid, ctid)", tmp)); err != nil {
+		return "", fmt.Errorf("failed to index temporary table: %w", err)
+	}
+	s.tables[table] = tmp
+	return tmp, nil
+}
+
+// insert adds the rows of table matching the condition, and returns the number of new rows
+func (s *subsetState) insert(table, condition string) (int64, error) {
+	tmp, err := s.rowsTable(table)
+	if err != nil {
+		return 0, err
+	}
+	query := fmt.Sprintf(`INSERT INTO %[1]s SELECT t.tableoid, t.ctid FROM %[2]s t
+		WHERE (%[3]s) AND NOT EXISTS (SELECT 1 FROM %[1]s s WHERE s.tableoid = t.tableoid AND s.ctid = t.ctid)`, tmp, table, condition)
+	tag, err := s.tx.Exec(s.ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select rows of %s: %w", table, err)
+	}
+	// Temporary tables are not analyzed by autovacuum, keep the statistics of the joins up to date
+	if tag.RowsAffected() > 0 {
+		if _, err = s.tx.Exec(s.ctx, "ANALYZE "+tmp); err != nil {
+			return 0, fmt.Errorf("failed to analyze temporary table: %w", err)
+		}
+	}
+	return tag.RowsAffected(), nil
+}
+
+// follow selects the rows of target referenced by, or referencing, the selected rows of source
+func (s *subsetState) follow(target, source string, targetColumns, sourceColumns []string) (int64, error) {
+	sourceTmp, ok := s.tables[source]
+	if !ok {
+		return 0, nil
+	}
+	join := make([]string, len(targetColumns))
+	for i := range targetColumns {
+		join[i] = fmt.Sprintf("o.%s = t.%s", sourceColumns[i], targetColumns[i])
+	}
+	condition := fmt.Sprintf(`EXISTS (SELECT 1 FROM %s o JOIN %s r ON r.tableoid = o.tableoid AND r.ctid = o.ctid WHERE %s)`,
+		source, sourceTmp, strings.Join(join, " AND "))
+	return s.insert(target, condition)
+}
+
+// dumpSubset dumps the full schema and a referentially consistent subset of the data.
+// Rows matching the root queries are selected first, then the rows referencing them, and finally
+// every row referenced by a selected row, so that all foreign keys can be restored.
+// The data of tables excluded by the backup filters is not dumped.
+func dumpSubset(db *dbConfig, config *BackupConfig, dumpArgs []string, outputPath string) error {
+	if len(config.tables) > 0 || config.schemaOnly || config.dataOnly {
+		return fmt.Errorf("subset backup cannot be combined with tables, schema-only or data-only")
+	}
+	roots, err := parseSubsetRoots(config.subset)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	conn, err := dbConnect(db)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer func(conn *pgx.Conn, ctx context.Context) {
+		err := conn.Close(ctx)
+		if err != nil {
+			logger.Error("Error closing connection", "error", err)
+		}
+	}(conn, ctx)
+
+	// Selected rows are tracked in temporary tables, which cannot be created on a hot standby
+	var inRecovery bool
+	if err = conn.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return fmt.Errorf("failed to check the server role: %w", err)
+	}
+	if inRecovery {
+		return fmt.Errorf("subset backup is not supported on a hot standby, it needs a primary server to create temporary tables")
+	}
+
+	filter := config.tableFilter()
+	masked := map[string]maskedTable{}
+	if config.masking != nil {
+		logger.Info("Validating masking profile...", "rules", len(config.masking.Rules))
+		tables, err := config.masking.resolve(ctx, conn, filter)
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			masked[table.qualifiedName()] = table
+		}
+		logger.Info("Validating masking profile...done", "tables", len(tables))
+	}
+
+	// The transaction is not read-only, selected rows are tracked in temporary tables
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+	var snapshot string
+	if err = tx.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&snapshot); err != nil {
+		return fmt.Errorf("failed to export snapshot: %w", err)
+	}
+	keys, err := listForeignKeys(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	var selected map[string]bool
+	if !filter.empty() {
+		relations, err := filter.selectedRelations(ctx, tx)
+		if err != nil {
+			return err
+		}
+		selected = map[string]bool{}
+		for _, r := range relations {
+			selected[pgx.Identifier{r.schema, r.name}.Sanitize()] = true
+		}
+	}
+
+	state := &subsetState{ctx: ctx, tx: tx, tables: map[string]string{}}
+	logger.Info("Selecting subset rows...", "roots", len(roots))
+	for _, root := range roots {
+		if selected != nil && !selected[root.table] {
+			return fmt.Errorf("subset root %s is excluded from the backup", root.table)
+		}
+		condition := root.condition
+		if condition == "" {
+			condition = "true"
+		}
+		count, err := state.insert(root.table, condition)
+		if err != nil {
+			return err
+		}
+		logger.Info("Subset root selected", "table", root.table, "rows", count)
+	}
+	// Rows referencing the selected rows
+	if err = state.expand(keys, true); err != nil {
+		return err
+	}
+	// Rows referenced by the selected rows
+	if err = state.expand(keys, false); err != nil {
+		return err
+	}
+
+	out, closeOut, err := createDumpWriter(outputPath, !config.disableCompression)
+	if err != nil {
+		return err
+	}
+	defer closeOut()
+
+	args := append([]string{"--snapshot", snapshot}, dumpArgs...)
+	if err = runDumpSection(out, args, []string{"--section=pre-data"}); err != nil {
+		return err
+	}
+	tableNames := make([]string, 0, len(state.tables))
+	for table := range state.tables {
+		tableNames = append(tableNames, table)
+	}
+	sort.Strings(tableNames)
+	for _, name := range tableNames {
+		var count int64
+		if err = tx.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM %s", state.tables[name])).Scan(&count); err != nil {
+			return fmt.Errorf("failed to count rows of %s: %w", name, err)
+		}
+		if count == 0 {
+			continue
+		}
+		if selected != nil && !selected[name] {
+			logger.Info("Skipping subset table excluded from the backup", "table", name, "rows", count)
+			continue
+		}
+		table, ok := masked[name]
+		if !ok {
+			if table, err = plainTable(ctx, tx, name); err != nil {
+				return err
+			}
+		}
+		logger.Info("Dumping subset table", "table", name, "rows", count)
+		where := fmt.Sprintf(" t WHERE EXISTS (SELECT 1 FROM %s r WHERE r.tableoid = t.tableoid AND r.ctid = t.ctid)", state.tables[name])
+		if err = writeTableData(ctx, tx, out, table, where); err != nil {
+			return err
+		}
+	}
+	if err = writeSequenceValues(ctx, tx, out, filter); err != nil {
+		return err
+	}
+	if err = runDumpSection(out, args, []string{"--section=post-data"}); err != nil {
+		return err
+	}
+	logger.Info("Database subset has been backed up", "tables", len(tableNames))
+	return nil
+}
+
+// expand follows the foreign keys until no new row is selected, either towards the referencing tables or the referenced ones
+func (s *subsetState) expand(keys []foreignKey, referencing bool) error {
+	for {
+		var added int64
+		for _, key := range keys {
+			var (
+				count int64
+				err   error
+			)
+			if referencing {
+				count, err = s.follow(key.child, key.parent, key.childColumns, key.parentColumns)
+			} else {
+				count, err = s.follow(key.parent, key.child, key.parentColumns, key.childColumns)
+			}
+			if err != nil {
+				return err
+			}
+			added += count
+		}
+		if added == 0 {
+			return nil
+		}
+	}
+}
+
+// plainTable returns the unmasked export of a table
+func plainTable(ctx context.Context, tx pgx.Tx, qualifiedName string) (maskedTable, error) {
+	var schema, name string
+	err := tx.QueryRow(ctx, `SELECT n.nspname, c.relname FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.oid = $1::text::regclass`, qualifiedName).Scan(&schema, &name)
+	if err != nil {
+		return maskedTable{}, fmt.Errorf("failed to find table %s: %w", qualifiedName, err)
+	}
+	columns, err := tableColumns(ctx, tx.Conn(), schema, name)
+	if err != nil {
+		return maskedTable{}, err
+	}
+	table := maskedTable{schema: schema, name: name}
+	for _, column := range columns {
+		if column.generated {
+			continue
+		}
+		ident := pgx.Identifier{column.name}.Sanitize()
+		table.columns = append(table.columns, ident)
+		table.selects = append(table.selects, ident)
+	}
+	return table, nil
+}
+
+// writeSequenceValues restores the sequence values, the data section of pg_dump is not used in subset mode.
+// As with pg_dump, the table filters also apply to sequences.
+func writeSequenceValues(ctx context.Context, tx pgx.Tx, out io.Writer, filter tableFilter) error {
+	rows, err := tx.Query(ctx, `SELECT schemaname, sequencename,
+		pg_table_is_visible(format('%I.%I', schemaname, sequencename)::regclass), last_value
+		FROM pg_sequences WHERE last_value IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to list sequences: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			sequence  relation
+			lastValue int64
+		)
+		if err := rows.Scan(&sequence.schema, &sequence.name, &sequence.visible, &lastValue); err != nil {
+			return fmt.Errorf("failed to scan sequence: %w", err)
+		}
+		if !filter.dumpsData(sequence) {
+			continue
+		}
+		name := pgx.Identifier{sequence.schema, sequence.name}.Sanitize()
+		if _, err := fmt.Fprintf(out, "SELECT pg_catalog.setval(%s, %d, true);\n", quoteLiteral(name), lastValue); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,54 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import "testing"
+
+func TestParseSubsetRoots(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    string
+		want    subsetRoot
+		wantErr bool
+	}{
+		{"table and condition", "customers where id < 100", subsetRoot{`"public"."customers"`, "id < 100"}, false},
+		{"schema qualified", "sales.orders WHERE created_at > now() - interval '7 days'",
+			subsetRoot{`"sales"."orders"`, "created_at > now() - interval '7 days'"}, false},
+		{"multi-line condition", "customers\n  where country = 'FR'\n  and active", subsetRoot{`"public"."customers"`, "country = 'FR'\n  and active"}, false},
+		{"whole table", "  countries  ", subsetRoot{`"public"."countries"`, ""}, false},
+		{"empty", "", subsetRoot{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roots, err := parseSubsetRoots([]string{tt.root})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSubsetRoots() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && roots[0] != tt.want {
+				t.Errorf("parseSubsetRoots() = %+v, want %+v", roots[0], tt.want)
+			}
+		})
+	}
+}
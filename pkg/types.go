@@ -24,6 +24,11 @@
 
 package pkg
 
+import (
+	"github.com/jkaninda/pg-bkup/utils"
+	"time"
+)
+
 type StorageType string
 type Database struct {
 	Host     string `yaml:"host"`
@@ -31,12 +36,107 @@ type Database struct {
 	Name     string `yaml:"name"`
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
-	Path     string `yaml:"path"`
+	// Service is a pg_service.conf entry, overrides DB_SERVICE
+	Service          string   `yaml:"service"`
+	Path             string   `yaml:"path"`
+	Tables           []string `yaml:"tables"`
+	Schemas          []string `yaml:"schemas"`
+	ExcludeTables    []string `yaml:"excludeTables"`
+	ExcludeSchemas   []string `yaml:"excludeSchemas"`
+	ExcludeTableData []string `yaml:"excludeTableData"`
+	Subset           []string `yaml:"subset"`
+	// SSLMode overrides the DB_SSLMODE environment variable: disable, allow, prefer, require, verify-ca or verify-full
+	SSLMode     string `yaml:"sslMode"`
+	SSLRootCert string `yaml:"sslRootCert"`
+	SSLCert     string `yaml:"sslCert"`
+	SSLKey      string `yaml:"sslKey"`
+	// Storage overrides the STORAGE environment variable
+	Storage        string `yaml:"storage"`
+	CronExpression string `yaml:"cronExpression"`
+	// BackupRetentionDays overrides the BACKUP_RETENTION_DAYS environment variable
+	BackupRetentionDays *int                  `yaml:"backupRetentionDays"`
+	DisableCompression  *bool                 `yaml:"disableCompression"`
+	SchemaOnly          bool                  `yaml:"schemaOnly"`
+	DataOnly            bool                  `yaml:"dataOnly"`
+	GpgPassphrase       string                `yaml:"gpgPassphrase"`
+	GpgPublicKey        string                `yaml:"gpgPublicKey"`
+	Notification        *DatabaseNotification `yaml:"notification"`
+}
+
+// DatabaseNotification overrides the notification recipients of a database
+type DatabaseNotification struct {
+	MailTo         string `yaml:"mailTo"`
+	MailCc         string `yaml:"mailCc"`
+	MailBcc        string `yaml:"mailBcc"`
+	TelegramChatId string `yaml:"telegramChatId"`
 }
 type Config struct {
 	CronExpression   string     `yaml:"cronExpression"`
 	BackupRescueMode bool       `yaml:"backupRescueMode"`
 	Databases        []Database `yaml:"databases"`
+	Jobs             []Job      `yaml:"jobs"`
+	// StateFile stores the last run time of each job, overrides BACKUP_STATE_FILE
+	StateFile string `yaml:"stateFile"`
+	// Concurrency is the number of databases backed up in parallel, overrides BACKUP_CONCURRENCY
+	Concurrency int `yaml:"concurrency"`
+	// MaxBackupAge notifies when a database has no successful backup within this duration, overrides BACKUP_MAX_AGE
+	MaxBackupAge string `yaml:"maxBackupAge"`
+	// Notifications adds notification channels to the ones defined by environment variables
+	Notifications []utils.NotifierConfig `yaml:"notifications"`
+	// Schedule holds the default schedule settings of all jobs
+	Schedule `yaml:",inline"`
+}
+
+// Schedule holds the scheduler settings of a job
+type Schedule struct {
+	Timezone string `yaml:"timezone"`
+	// Jitter delays each run by a random duration up to the given value, e.g. 5m
+	Jitter string `yaml:"jitter"`
+	// OverlapPolicy defines what happens when a run is still in progress: skip (default) or queue
+	OverlapPolicy string `yaml:"overlapPolicy"`
+	// CatchUp runs the job at startup if the last scheduled run was missed
+	CatchUp *bool `yaml:"catchUp"`
+}
+
+// BackupType defines what a job backs up
+type BackupType string
+
+// Job is a scheduled backup of one or more databases
+type Job struct {
+	Name           string `yaml:"name"`
+	CronExpression string `yaml:"cronExpression"`
+	// Databases references the names of the databases section, all databases when empty
+	Databases           []string   `yaml:"databases"`
+	Type                BackupType `yaml:"type"`
+	Storage             string     `yaml:"storage"`
+	Path                string     `yaml:"path"`
+	BackupRetentionDays *int       `yaml:"backupRetentionDays"`
+	// Concurrency overrides the global concurrency for this job
+	Concurrency int `yaml:"concurrency"`
+	// HeartbeatURL is pinged when the job starts, succeeds or fails, overrides HEARTBEAT_URL
+	HeartbeatURL string `yaml:"heartbeatUrl"`
+	Schedule     `yaml:",inline"`
+}
+
+// MaskingStrategy defines how a column value is anonymized
+type MaskingStrategy string
+
+// MaskingRule masks a single column of a table
+type MaskingRule struct {
+	Table    string          `yaml:"table"`
+	Column   string          `yaml:"column"`
+	Strategy MaskingStrategy `yaml:"strategy"`
+	// Value is used by the fixed strategy
+	Value string `yaml:"value"`
+	// Keep is the number of leading characters kept by the partial strategy
+	Keep int `yaml:"keep"`
+}
+
+// MaskingProfile holds the masking rules applied while dumping or migrating
+type MaskingProfile struct {
+	// Salt is prepended to the values hashed by the hash and fake_email strategies
+	Salt  string        `yaml:"salt"`
+	Rules []MaskingRule `yaml:"rules"`
 }
 
 type dbConfig struct {
@@ -45,6 +145,21 @@ type dbConfig struct {
 	dbName     string
 	dbUserName string
 	dbPassword string
+	// service is a pg_service.conf entry, settings left empty are read from the service file
+	service string
+	ssl     sslConfig
+	// params holds additional connection parameters, e.g. target_session_attrs or connect_timeout
+	params map[string]string
+	// serverVersion is the PostgreSQL server version, set by testDatabaseConnection
+	serverVersion string
+}
+
+// sslConfig holds the TLS settings of a PostgreSQL connection, as defined by libpq
+type sslConfig struct {
+	mode     string
+	rootCert string
+	cert     string
+	key      string
 }
 type targetDbConfig struct {
 	targetDbHost     string
@@ -52,6 +167,9 @@ type targetDbConfig struct {
 	targetDbUserName string
 	targetDbPassword string
 	targetDbName     string
+	targetDbService  string
+	targetDbSsl      sslConfig
+	targetDbParams   map[string]string
 }
 type TgConfig struct {
 	Token  string
@@ -63,19 +181,55 @@ type BackupConfig struct {
 	disableCompression bool
 	prune              bool
 	remotePath         string
-	encryption         bool
-	usingKey           bool
-	passphrase         string
-	publicKey          string
-	storage            StorageType
-	cronExpression     string
-	all                bool
-	allInOne           bool
-	customName         string
-	allowCustomName    bool
-	schemaOnly         bool
-	dataOnly           bool
-	tables             []string
+	// localPath is the directory of the local storage, storagePath unless the database or the job sets path
+	localPath        string
+	encryption       bool
+	usingKey         bool
+	passphrase       string
+	publicKey        string
+	storage          StorageType
+	cronExpression   string
+	all              bool
+	allInOne         bool
+	customName       string
+	allowCustomName  bool
+	schemaOnly       bool
+	dataOnly         bool
+	tables           []string
+	schemas          []string
+	excludeTables    []string
+	excludeSchemas   []string
+	excludeTableData []string
+	withGlobals      bool
+	noRolePasswords  bool
+	globalsOnly      bool
+	// globals is the globals run of the instance, referenced by the notifications of its databases
+	globals    *backupRun
+	masking    *MaskingProfile
+	subset     []string
+	recipients *utils.Recipients
+	// concurrency is the number of databases backed up in parallel
+	concurrency int
+	// slots bounds the number of backups of the job running at the same time, shared by its databases
+	slots chan struct{}
+	// jobName is the name of the job the backup belongs to
+	jobName string
+	// trigger is the source of the backup recorded in the run history: manual, schedule or api
+	trigger string
+	// catalog receives the backup runs when CATALOG_DB_URL is set
+	catalog *catalog
+	// heartbeat is pinged when the job starts, succeeds or fails
+	heartbeat heartbeat
+	// maxBackupAge enables the watchdog in scheduled mode
+	maxBackupAge time.Duration
+	// runJobs are the jobs of the configuration file run immediately
+	runJobs []string
+	// apiListen is the address of the HTTP API in scheduled mode
+	apiListen string
+	// metricsListen is the address of the metrics server in scheduled mode
+	metricsListen string
+	// run holds the state of the backup in progress
+	run *backupRun
 }
 type FTPConfig struct {
 	host       string
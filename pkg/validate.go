@@ -0,0 +1,543 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redacted = "********"
+
+// storageEnvVars lists the environment variables used by each storage
+var storageEnvVars = map[StorageType][]string{
+	S3Storage:    {"AWS_S3_ENDPOINT", "AWS_S3_BUCKET_NAME", "AWS_REGION", "AWS_S3_PATH", "AWS_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_DISABLE_SSL", "AWS_FORCE_PATH_STYLE"},
+	SSHStorage:   {"SSH_HOST", "SSH_PORT", "SSH_USER", "SSH_PASSWORD", "SSH_IDENTIFY_FILE", "REMOTE_PATH"},
+	FTPStorage:   {"FTP_HOST", "FTP_PORT", "FTP_USER", "FTP_PASSWORD", "REMOTE_PATH"},
+	AzureStorage: {"AZURE_STORAGE_CONTAINER_NAME", "AZURE_STORAGE_ACCOUNT_NAME", "AZURE_STORAGE_ACCOUNT_KEY"},
+}
+
+// secretEnvVars are redacted when printing the configuration
+var secretEnvVars = map[string]bool{
+	"AWS_ACCESS_KEY":            true,
+	"AWS_SECRET_KEY":            true,
+	"SSH_PASSWORD":              true,
+	"FTP_PASSWORD":              true,
+	"AZURE_STORAGE_ACCOUNT_KEY": true,
+}
+
+// configReport collects the issues found while validating the configuration
+type configReport struct {
+	errors   []string
+	warnings []string
+}
+
+func (r *configReport) errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *configReport) warnf(format string, args ...any) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+// ValidateConfig validates the configuration file or environment variables without running any backup
+func ValidateConfig(cmd *cobra.Command) {
+	testConnection, _ := cmd.Flags().GetBool("test-connection")
+	conf, configFile, err := loadValidationConfig(cmd)
+	if err != nil {
+		logger.Fatal("Configuration is not valid", "error", err)
+	}
+	if configFile != "" {
+		logger.Info("Validating configuration file", "file", configFile)
+	} else {
+		logger.Info("No configuration file found, validating environment variables")
+	}
+	report := &configReport{}
+	storages := validateConf(conf, configFile != "", defaultStorage(cmd), report)
+	if profile := os.Getenv("MASKING_PROFILE"); profile != "" {
+		if _, err := readMaskingProfile(profile); err != nil {
+			report.errorf("masking profile: %v", err)
+		}
+	}
+	if pubKey := os.Getenv("GPG_PUBLIC_KEY"); pubKey != "" && !utils.FileExists(pubKey) {
+		report.errorf("GPG public key %q not found", pubKey)
+	}
+	catalog, err := loadCatalog()
+	if err != nil {
+		report.errorf("catalog: %v", err)
+	}
+	if err := utils.ValidateNotifiers(notifierConfigs(conf)); err != nil {
+		report.errorf("notifications: %v", err)
+	}
+	for _, st := range storages {
+		if err := checkStorageConfig(st); err != nil {
+			report.errorf("storage %s: %v", st, err)
+		}
+	}
+	if testConnection && len(report.errors) == 0 {
+		for _, db := range conf.Databases {
+			if err := testDatabaseConnection(getDatabase(db)); err != nil {
+				report.errorf("database %q: %v", db.Name, err)
+			}
+		}
+		for _, st := range storages {
+			logger.Info("Connecting to storage ...", "storage", st)
+			if err := testStorageConnection(st); err != nil {
+				report.errorf("storage %s: %v", st, err)
+				continue
+			}
+			logger.Info("Successfully connected to storage", "storage", st)
+		}
+		if catalog != nil {
+			if err := testDatabaseConnection(catalog.db); err != nil {
+				report.errorf("catalog: %v", err)
+			}
+		}
+	}
+	for _, warning := range report.warnings {
+		logger.Warn(warning)
+	}
+	for _, e := range report.errors {
+		logger.Error(e)
+	}
+	if len(report.errors) > 0 {
+		logger.Fatal("Configuration is not valid", "errors", len(report.errors), "warnings", len(report.warnings))
+	}
+	logger.Info("Configuration is valid", "databases", len(conf.Databases), "warnings", len(report.warnings))
+}
+
+// PrintConfig prints the resolved configuration with secrets redacted
+func PrintConfig(cmd *cobra.Command) {
+	conf, _, err := loadValidationConfig(cmd)
+	if err != nil {
+		logger.Fatal("Error loading configuration", "error", err)
+	}
+	resolved := *conf
+	resolved.Databases = make([]Database, len(conf.Databases))
+	for i, db := range conf.Databases {
+		dbConf := getDatabase(db)
+		db.Host = dbConf.dbHost
+		db.Port = dbConf.dbPort
+		db.Service = dbConf.service
+		db.User = dbConf.dbUserName
+		db.Password = redact(dbConf.dbPassword)
+		db.SSLMode = dbConf.ssl.mode
+		db.SSLRootCert = dbConf.ssl.rootCert
+		db.SSLCert = dbConf.ssl.cert
+		db.SSLKey = dbConf.ssl.key
+		db.GpgPassphrase = redact(db.GpgPassphrase)
+		resolved.Databases[i] = db
+	}
+	resolved.Notifications = notifierConfigs(conf)
+	for i, n := range resolved.Notifications {
+		n.URL = redact(n.URL)
+		n.Secret = redact(n.Secret)
+		n.RoutingKey = redact(n.RoutingKey)
+		n.APIKey = redact(n.APIKey)
+		for key, value := range n.Headers {
+			n.Headers[key] = redact(value)
+		}
+		resolved.Notifications[i] = n
+	}
+	storages := map[string]map[string]string{}
+	for _, st := range usedStorages(conf, defaultStorage(cmd)) {
+		settings := map[string]string{}
+		for _, env := range storageEnvVars[storageKind(st)] {
+			if value := utils.Env(env); value != "" {
+				if secretEnvVars[env] {
+					value = redacted
+				}
+				settings[env] = value
+			}
+		}
+		storages[string(st)] = settings
+	}
+	var doc map[string]any
+	buf, err := yaml.Marshal(resolved)
+	if err == nil {
+		err = yaml.Unmarshal(buf, &doc)
+	}
+	if err != nil {
+		logger.Fatal("Error encoding configuration", "error", err)
+	}
+	doc["storages"] = storages
+	buf, err = yaml.Marshal(pruneEmpty(doc))
+	if err != nil {
+		logger.Fatal("Error encoding configuration", "error", err)
+	}
+	fmt.Print(string(buf))
+}
+
+// loadValidationConfig reads the configuration file in strict mode, or builds a single database configuration
+// from environment variables when no configuration file is set with --config or BACKUP_CONFIG_FILE nor found
+func loadValidationConfig(cmd *cobra.Command) (*Config, string, error) {
+	configPath := utils.GetEnv(cmd, "config", "BACKUP_CONFIG_FILE")
+	utils.GetEnv(cmd, "dbname", "DB_NAME")
+	cronExpression := utils.GetEnv(cmd, "cron-expression", "BACKUP_CRON_EXPRESSION")
+	configFile, err := loadConfigFile()
+	if err != nil {
+		if configPath != "" {
+			return nil, configPath, fmt.Errorf("%w: %s", err, configPath)
+		}
+		db, err := envDatabase()
+		if err != nil {
+			return nil, "", err
+		}
+		return &Config{CronExpression: cronExpression, Databases: []Database{db}}, "", nil
+	}
+	conf, err := readConf(configFile, true)
+	if err != nil {
+		return nil, configFile, err
+	}
+	if conf.CronExpression == "" {
+		conf.CronExpression = cronExpression
+	}
+	return conf, configFile, nil
+}
+
+// envDatabase returns the database defined by environment variables
+func envDatabase() (Database, error) {
+	if jdbcUri := utils.Env("DB_URL"); jdbcUri != "" {
+		db, err := parseConnectionURI(jdbcUri)
+		if err != nil {
+			return Database{}, fmt.Errorf("DB_URL: %w", err)
+		}
+		if db.dbName == "" {
+			db.dbName = os.Getenv("DB_NAME")
+		}
+		return Database{Host: db.dbHost, Port: db.dbPort, Name: db.dbName, User: db.dbUserName, Password: db.dbPassword,
+			Service: db.service, SSLMode: db.ssl.mode, SSLRootCert: db.ssl.rootCert, SSLCert: db.ssl.cert, SSLKey: db.ssl.key}, nil
+	}
+	return Database{
+		Host:     os.Getenv("DB_HOST"),
+		Port:     os.Getenv("DB_PORT"),
+		Name:     os.Getenv("DB_NAME"),
+		User:     utils.Env("DB_USERNAME"),
+		Password: utils.Env("DB_PASSWORD"),
+		Service:  utils.EnvWithDefault("DB_SERVICE", os.Getenv("PGSERVICE")),
+	}, nil
+}
+
+// validateConf checks the databases and jobs, and returns the storages in use
+func validateConf(conf *Config, fromFile bool, storage StorageType, report *configReport) []StorageType {
+	if len(conf.Databases) == 0 {
+		report.errorf("no databases found")
+	}
+	names := map[string]bool{}
+	for i, db := range conf.Databases {
+		label := db.Name
+		if fromFile && db.Name == "" {
+			label = fmt.Sprintf("#%d", i+1)
+			report.errorf("database %s: name is required", label)
+		}
+		if fromFile && names[db.Name] {
+			report.warnf("database %q is defined more than once", db.Name)
+		}
+		names[db.Name] = true
+		if !checkSecretFile(fmt.Sprintf("database %q: password", label), utils.ReplaceEnvVars(db.Password), report) ||
+			!checkSecretFile(fmt.Sprintf("database %q: gpgPassphrase", label), utils.ReplaceEnvVars(db.GpgPassphrase), report) {
+			continue
+		}
+		dbConf := getDatabase(db)
+		// Connection settings are read from the service file when a service is defined
+		if dbConf.service == "" {
+			if dbConf.dbHost == "" {
+				report.errorf("database %q: host is not set", label)
+			}
+			if dbConf.dbUserName == "" {
+				report.errorf("database %q: user is not set", label)
+			}
+			if dbConf.dbPassword == "" {
+				report.errorf("database %q: password is not set", label)
+			}
+		}
+		if err := dbConf.ssl.validate(); err != nil {
+			report.errorf("database %q: %v", label, err)
+		}
+		if dbConf.dbPort != "" {
+			for _, port := range strings.Split(dbConf.dbPort, ",") {
+				if _, err := strconv.Atoi(port); err != nil {
+					report.errorf("database %q: invalid port %q", label, dbConf.dbPort)
+					break
+				}
+			}
+		}
+		if db.SchemaOnly && db.DataOnly {
+			report.errorf("database %q: schemaOnly and dataOnly cannot be used together", label)
+		}
+		if len(db.Subset) > 0 && (len(db.Tables) > 0 || db.SchemaOnly || db.DataOnly) {
+			report.errorf("database %q: subset cannot be combined with tables, schemaOnly or dataOnly", label)
+		}
+		if db.BackupRetentionDays != nil && *db.BackupRetentionDays < 0 {
+			report.errorf("database %q: backupRetentionDays must be positive", label)
+		}
+		if db.GpgPublicKey != "" && !utils.FileExists(utils.ReplaceEnvVars(db.GpgPublicKey)) {
+			report.errorf("database %q: GPG public key %q not found", label, db.GpgPublicKey)
+		}
+	}
+	if conf.Concurrency < 0 {
+		report.errorf("concurrency must be positive")
+	}
+	if _, err := parseMaxBackupAge(conf.MaxBackupAge); err != nil {
+		report.errorf("maxBackupAge: %v", err)
+	}
+	if _, err := parseMaxBackupAge(os.Getenv("BACKUP_MAX_AGE")); err != nil {
+		report.errorf("BACKUP_MAX_AGE: %v", err)
+	}
+	jobs, err := resolveJobs(conf, conf.CronExpression)
+	if err != nil {
+		report.errorf("%v", err)
+	}
+	defaults := conf.Schedule.merge(initSchedule())
+	for _, job := range jobs {
+		if job.Concurrency < 0 {
+			report.errorf("job %q: concurrency must be positive", job.Name)
+		}
+		if job.HeartbeatURL != "" && !strings.HasPrefix(job.HeartbeatURL, "http://") && !strings.HasPrefix(job.HeartbeatURL, "https://") {
+			report.errorf("job %q: heartbeatUrl must be an http or https URL", job.Name)
+		}
+		if job.CronExpression == "" {
+			continue
+		}
+		if err := job.Schedule.merge(defaults).validate(job.CronExpression); err != nil {
+			report.errorf("job %q: %v", job.Name, err)
+		}
+		if job.BackupRetentionDays != nil && *job.BackupRetentionDays < 0 {
+			report.errorf("job %q: backupRetentionDays must be positive", job.Name)
+		}
+	}
+	storages := usedStorages(conf, storage)
+	for _, st := range storages {
+		if _, ok := storageEnvVars[storageKind(st)]; !ok && st != LocalStorage {
+			report.errorf("unknown storage %q, expected local, s3, ssh, ftp or azure", st)
+		}
+	}
+	return storages
+}
+
+// checkSecretFile checks that the file referenced by a "file:" value can be read
+func checkSecretFile(label, value string, report *configReport) bool {
+	if _, err := readSecret(value); err != nil {
+		report.errorf("%s: %v", label, err)
+		return false
+	}
+	return true
+}
+
+// usedStorages returns the distinct storages used by the databases and jobs
+func usedStorages(conf *Config, storage StorageType) []StorageType {
+	seen := map[StorageType]bool{}
+	var storages []StorageType
+	add := func(st StorageType) {
+		if st == "" || seen[st] {
+			return
+		}
+		seen[st] = true
+		storages = append(storages, st)
+	}
+	add(storage)
+	for _, db := range conf.Databases {
+		add(StorageType(strings.ToLower(db.Storage)))
+	}
+	for _, job := range conf.Jobs {
+		add(StorageType(strings.ToLower(job.Storage)))
+	}
+	sort.Slice(storages, func(i, j int) bool { return storages[i] < storages[j] })
+	return storages
+}
+
+// defaultStorage returns the storage defined by the flag or the STORAGE environment variable
+func defaultStorage(cmd *cobra.Command) StorageType {
+	storage := strings.ToLower(utils.GetEnv(cmd, "storage", "STORAGE"))
+	if storage == "" {
+		return LocalStorage
+	}
+	return StorageType(storage)
+}
+
+// storageKind returns the storage type, ssh aliases included
+func storageKind(storage StorageType) StorageType {
+	switch storage {
+	case SFTPStorage, RemoteStorage:
+		return SSHStorage
+	}
+	return storage
+}
+
+// checkStorageConfig checks that the required settings of a storage are set
+func checkStorageConfig(storage StorageType) error {
+	switch storageKind(storage) {
+	case LocalStorage:
+		info, err := os.Stat(storagePath)
+		if err != nil {
+			return fmt.Errorf("backup directory %q: %w", storagePath, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("backup path %q is not a directory", storagePath)
+		}
+	case S3Storage:
+		utils.GetEnvVariable("AWS_S3_ENDPOINT", "S3_ENDPOINT")
+		utils.GetEnvVariable("AWS_ACCESS_KEY", "ACCESS_KEY")
+		utils.GetEnvVariable("AWS_SECRET_KEY", "SECRET_KEY")
+		utils.GetEnvVariable("AWS_S3_BUCKET_NAME", "BUCKET_NAME")
+		return utils.CheckEnvVars(awsVars)
+	case SSHStorage:
+		utils.GetEnvVariable("SSH_HOST", "SSH_HOST_NAME")
+		if err := utils.CheckEnvVars([]string{"SSH_USER", "SSH_HOST", "SSH_PORT", "REMOTE_PATH"}); err != nil {
+			return err
+		}
+		identifyFile := os.Getenv("SSH_IDENTIFY_FILE")
+		if utils.Env("SSH_PASSWORD") == "" && identifyFile == "" {
+			return fmt.Errorf("SSH_PASSWORD or SSH_IDENTIFY_FILE is required")
+		}
+		if identifyFile != "" && !utils.FileExists(identifyFile) {
+			return fmt.Errorf("SSH identity file %q not found", identifyFile)
+		}
+	case FTPStorage:
+		utils.GetEnvVariable("FTP_HOST", "FTP_HOST_NAME")
+		return utils.CheckEnvVars([]string{"FTP_HOST", "FTP_USER", "FTP_PASSWORD", "FTP_PORT"})
+	case AzureStorage:
+		return utils.CheckEnvVars(azureVars)
+	}
+	return nil
+}
+
+// testStorageConnection checks that a storage is reachable
+func testStorageConnection(storage StorageType) error {
+	switch storageKind(storage) {
+	case LocalStorage:
+		f, err := os.CreateTemp(storagePath, ".pg-bkup-")
+		if err != nil {
+			return fmt.Errorf("backup directory is not writable: %w", err)
+		}
+		_ = f.Close()
+		return os.Remove(f.Name())
+	case S3Storage:
+		client, err := newS3Client()
+		if err != nil {
+			return err
+		}
+		_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(os.Getenv("AWS_S3_BUCKET_NAME"))})
+		return err
+	case SSHStorage:
+		return dialStorage(net.JoinHostPort(os.Getenv("SSH_HOST"), os.Getenv("SSH_PORT")))
+	case FTPStorage:
+		return dialStorage(net.JoinHostPort(os.Getenv("FTP_HOST"), os.Getenv("FTP_PORT")))
+	case AzureStorage:
+		endpoint := fmt.Sprintf("https://%s.blob.core.windows.net", os.Getenv("AZURE_STORAGE_ACCOUNT_NAME"))
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return err
+		}
+		return dialStorage(net.JoinHostPort(u.Hostname(), "443"))
+	}
+	return nil
+}
+
+// newS3Client creates an S3 client from the AWS_* environment variables
+func newS3Client() (*s3.S3, error) {
+	disableSsl, _ := strconv.ParseBool(os.Getenv("AWS_DISABLE_SSL"))
+	forcePathStyle, _ := strconv.ParseBool(os.Getenv("AWS_FORCE_PATH_STYLE"))
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials(utils.Env("AWS_ACCESS_KEY"), utils.Env("AWS_SECRET_KEY"), ""),
+		Endpoint:         aws.String(os.Getenv("AWS_S3_ENDPOINT")),
+		Region:           aws.String(os.Getenv("AWS_REGION")),
+		DisableSSL:       aws.Bool(disableSsl),
+		S3ForcePathStyle: aws.Bool(forcePathStyle),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// dialStorage checks that a storage server accepts connections
+func dialStorage(address string) error {
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// redact hides a secret value
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redacted
+}
+
+// pruneEmpty removes empty values from a decoded YAML document
+func pruneEmpty(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			item = pruneEmpty(item)
+			if isEmpty(item) {
+				delete(v, key)
+				continue
+			}
+			v[key] = item
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = pruneEmpty(item)
+		}
+		return v
+	}
+	return value
+}
+
+func isEmpty(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
@@ -24,30 +24,31 @@
 
 package pkg
 
-import (
-	"time"
-)
-
 const (
-	tmpPath       = "/tmp/backup"
+	// defaultTmpDir holds the working directories of the runs, overridden by BACKUP_TMP_DIR
+	defaultTmpDir = "/tmp/backup"
 	gpgHome       = "/config/gnupg"
 	gpgExtension  = "gpg"
 	timeFormat    = "2006-01-02 at 15:04:05"
 	defaultDbPort = "5432"
+	// defaultStateFile stores the last run time of scheduled jobs
+	defaultStateFile = "/config/pg-bkup-state.json"
+	// defaultHistoryFile stores the history of the backup runs
+	defaultHistoryFile = "/config/pg-bkup-history.jsonl"
+	// defaultHistoryMaxRecords is the number of runs kept in the history file, overridden by BACKUP_HISTORY_MAX_RECORDS
+	defaultHistoryMaxRecords = 10000
 )
 
 var (
 	storage = "local"
 	file    = ""
 
-	storagePath              = "/backup"
-	workingDir               = "/config"
-	disableCompression       = false
-	encryption               = false
-	usingKey                 = false
-	backupSize         int64 = 0
-	startTime                = time.Now()
-	backupRescueMode         = false
+	storagePath        = "/backup"
+	workingDir         = "/config"
+	disableCompression = false
+	encryption         = false
+	usingKey           = false
+	backupRescueMode   = false
 )
 
 // Storage type
@@ -61,6 +62,15 @@ var (
 	AzureStorage  StorageType = "azure"
 )
 
+// Backup types
+var (
+	FullBackup         BackupType = "full"
+	SchemaOnlyBackup   BackupType = "schema-only"
+	DataOnlyBackup     BackupType = "data-only"
+	AllDatabasesBackup BackupType = "all-databases"
+	AllInOneBackup     BackupType = "all-in-one"
+)
+
 // dbHVars Required environment variables for database
 var dbHVars = []string{
 	"DB_HOST",
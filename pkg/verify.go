@@ -0,0 +1,163 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2024 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	goutils "github.com/jkaninda/go-utils"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/utils"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// dumpCheckSize is the size of the beginning and the end of a dump searched for the pg_dump header and trailer
+const dumpCheckSize = 4096
+
+// StartVerify downloads a backup file and checks it without restoring it
+func StartVerify(cmd *cobra.Command) {
+	intro()
+	verifyConf := initRestoreConfig(cmd)
+	verifyConf.verifyOnly = true
+	workDir, err := newWorkDir()
+	if err != nil {
+		failOperation("Error creating working directory", "error", err)
+	}
+	defer removeWorkDir(workDir)
+	verifyConf.workDir = workDir
+	op := startOperation(utils.Event{
+		Storage:    string(verifyConf.storage),
+		SourceFile: verifyConf.file,
+	}, utils.VerifySucceeded, utils.VerifyFailed)
+
+	// The database is not used, the download functions are shared with the restore
+	db := &dbConfig{}
+	switch verifyConf.storage {
+	case S3Storage:
+		s3Restore(db, verifyConf)
+	case SSHStorage, SFTPStorage, RemoteStorage:
+		remoteRestore(db, verifyConf)
+	case FTPStorage:
+		ftpRestore(db, verifyConf)
+	case AzureStorage:
+		azureRestore(db, verifyConf)
+	default:
+		localRestore(db, verifyConf)
+	}
+	op.event.BackupSize = goutils.ConvertBytes(uint64(verifyConf.size))
+	op.event.Checksum = verifyConf.checksum
+	op.succeeded(0)
+}
+
+// verifyBackupFile compares the checksum of the downloaded file with the run history and checks the dump is complete
+func verifyBackupFile(conf *RestoreConfig, downloaded, dumpFile string) {
+	logger.Info("Verifying backup file...", "file", filepath.Base(downloaded))
+	name := filepath.Base(downloaded)
+	records, err := readHistory(historyFile(), historyFilter{status: historySuccess})
+	if err != nil {
+		logger.Warn("Could not read the run history, skipping checksum verification", "error", err)
+	}
+	expected := ""
+	for _, record := range records {
+		if record.File == name && record.Checksum != "" {
+			expected = record.Checksum
+			break
+		}
+	}
+	if expected == "" {
+		logger.Info("No checksum recorded for the backup file, skipping checksum verification", "file", name)
+	} else if actual := fileChecksum(downloaded); actual != expected {
+		failOperation("Backup file checksum mismatch", "file", name, "expected", expected, "actual", actual)
+	} else {
+		logger.Info("Backup file checksum verified", "checksum", actual)
+		conf.checksum = actual
+	}
+	if info, err := os.Stat(downloaded); err == nil {
+		conf.size = info.Size()
+	}
+	if err := checkDumpFile(dumpFile); err != nil {
+		failOperation("Backup file is not valid", "file", name, "error", err)
+	}
+	logger.Info("Backup file has been verified successfully.", "file", name)
+}
+
+// checkDumpFile reads the whole dump, checking the gzip stream and the pg_dump or pg_dumpall header and trailer
+func checkDumpFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	var reader io.Reader = f
+	switch filepath.Ext(path) {
+	case ".gz":
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("invalid gzip file: %w", err)
+		}
+		defer func() { _ = gzipReader.Close() }()
+		reader = gzipReader
+	case ".sql":
+	default:
+		return fmt.Errorf("unknown file extension %s", filepath.Ext(path))
+	}
+	head := make([]byte, dumpCheckSize)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read dump: %w", err)
+	}
+	head = head[:n]
+	if !bytes.Contains(head, []byte("-- PostgreSQL database dump")) && !bytes.Contains(head, []byte("-- PostgreSQL database cluster dump")) {
+		return errors.New("the file is not a PostgreSQL dump")
+	}
+	// Keep the end of the dump, reading it all checks the gzip checksum
+	tail := &tailBuffer{size: dumpCheckSize, buf: append([]byte(nil), head...)}
+	if _, err = io.Copy(tail, reader); err != nil {
+		return fmt.Errorf("failed to read dump: %w", err)
+	}
+	if !bytes.Contains(tail.buf, []byte("dump complete")) {
+		return errors.New("the dump is truncated, the pg_dump trailer is missing")
+	}
+	return nil
+}
+
+// tailBuffer keeps the last bytes written
+type tailBuffer struct {
+	size int
+	buf  []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.size {
+		t.buf = append([]byte(nil), t.buf[len(t.buf)-t.size:]...)
+	}
+	return len(p), nil
+}
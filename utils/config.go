@@ -25,8 +25,12 @@ SOFTWARE.
 package utils
 
 import (
+	"fmt"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 type MailConfig struct {
@@ -35,8 +39,15 @@ type MailConfig struct {
 	MailUserName string
 	MailPassword string
 	MailTo       string
+	MailCc       string
+	MailBcc      string
 	MailFrom     string
-	SkipTls      bool
+	// TLS is the TLS mode: none, starttls or tls, empty uses tls on port 465 and STARTTLS when supported otherwise
+	TLS string
+	// SkipTls skips the verification of the server certificate
+	SkipTls bool
+	// AttachLogs attaches the command output and the run log to the failure emails
+	AttachLogs bool
 }
 type NotificationData struct {
 	File            string
@@ -46,13 +57,23 @@ type NotificationData struct {
 	Storage         string
 	BackupLocation  string
 	BackupReference string
+	Recipients      *Recipients
+	// Job is the backup job, summarized by the digest notifiers
+	Job           string
+	Host          string
+	ServerVersion string
+	Checksum      string
+	// GlobalsLocation is the location of the globals dump taken with the backup
+	GlobalsLocation string
+	NextRun         time.Time
 }
-type ErrorMessage struct {
-	Database        string
-	EndTime         string
-	Error           string
-	BackupReference string
-	DatabaseName    string
+
+// Recipients overrides the notification recipients defined by environment variables
+type Recipients struct {
+	MailTo         string
+	MailCc         string
+	MailBcc        string
+	TelegramChatId string
 }
 
 // loadMailConfig gets mail environment variables and returns MailConfig
@@ -60,13 +81,109 @@ func loadMailConfig() *MailConfig {
 	return &MailConfig{
 		MailHost:     os.Getenv("MAIL_HOST"),
 		MailPort:     GetIntEnv("MAIL_PORT"),
-		MailUserName: os.Getenv("MAIL_USERNAME"),
-		MailPassword: os.Getenv("MAIL_PASSWORD"),
+		MailUserName: Env("MAIL_USERNAME"),
+		MailPassword: Env("MAIL_PASSWORD"),
 		MailTo:       os.Getenv("MAIL_TO"),
+		MailCc:       os.Getenv("MAIL_CC"),
+		MailBcc:      os.Getenv("MAIL_BCC"),
 		MailFrom:     strings.Trim(os.Getenv("MAIL_FROM"), `"`),
-		SkipTls:      os.Getenv("MAIL_SKIP_TLS") == "false",
+		TLS:          strings.ToLower(os.Getenv("MAIL_TLS")),
+		SkipTls:      os.Getenv("MAIL_SKIP_TLS") == "true",
+		AttachLogs:   os.Getenv("MAIL_ATTACH_LOGS") != "false",
+	}
+
+}
+
+// secrets holds the values read from secret files, kept out of the environment inherited by child processes
+var secrets = struct {
+	sync.RWMutex
+	values map[string]string
+}{values: map[string]string{}}
+
+// envPattern matches the ${NAME} references of the configuration file
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// LoadSecretFiles reads the secrets from the files referenced by their <name>_FILE variable,
+// e.g. DB_PASSWORD_FILE=/run/secrets/db_password
+func LoadSecretFiles() error {
+	for _, env := range os.Environ() {
+		name, path, _ := strings.Cut(env, "=")
+		key, ok := strings.CutSuffix(name, "_FILE")
+		if !ok || !isSecretEnvVar(key) {
+			continue
+		}
+		if os.Getenv(key) != "" {
+			return fmt.Errorf("both %s and %s are set, only one is allowed", key, name)
+		}
+		value, err := ReadSecretFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		setEnv(key, value)
+	}
+	return nil
+}
+
+// Env returns the value of an environment variable, or of the secret read from its <name>_FILE variable
+func Env(key string) string {
+	value, _ := lookupEnv(key)
+	return value
+}
+
+func lookupEnv(key string) (string, bool) {
+	secrets.RLock()
+	value, ok := secrets.values[key]
+	secrets.RUnlock()
+	if ok {
+		return value, true
+	}
+	return os.LookupEnv(key)
+}
+
+// setEnv sets an environment variable, secrets are kept in memory only
+func setEnv(key, value string) {
+	if !isSecretEnvVar(key) {
+		_ = os.Setenv(key, value)
+		return
 	}
+	secrets.Lock()
+	secrets.values[key] = value
+	secrets.Unlock()
+}
+
+// ReplaceEnvVars replaces the ${NAME} references by the value of the environment variables, including the secrets read from files
+func ReplaceEnvVars(s string) string {
+	return envPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if value, ok := lookupEnv(envPattern.FindStringSubmatch(match)[1]); ok {
+			return value
+		}
+		return match
+	})
+}
 
+// ReadSecretFile returns the content of a secret file without the trailing newline
+func ReadSecretFile(path string) (string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return strings.TrimRight(string(buf), "\r\n"), nil
+}
+
+// isSecretEnvVar reports whether an environment variable can be read from a file,
+// including the database credentials of a specific database such as DB_PASSWORD_FOO or FOO_DB_PASSWORD
+func isSecretEnvVar(name string) bool {
+	for _, secret := range secretVars {
+		if name == secret {
+			return true
+		}
+	}
+	for _, secret := range []string{"DB_USERNAME", "DB_PASSWORD"} {
+		if strings.HasPrefix(name, secret+"_") || strings.HasSuffix(name, "_"+secret) {
+			return true
+		}
+	}
+	return false
 }
 
 // TimeFormat returns the format of the time
@@ -83,15 +200,50 @@ func backupReference() string {
 	return os.Getenv("BACKUP_REFERENCE")
 }
 
-const templatePath = "/config/templates"
+// defaultTemplatesDir is the directory of the templates overriding the built-in ones
+const defaultTemplatesDir = "/config/templates"
+
+// templatesDir returns the directory of the templates overriding the built-in ones
+func templatesDir() string {
+	return EnvWithDefault("TEMPLATES_DIR", defaultTemplatesDir)
+}
 
-var DatabaseName = ""
 var mailVars = []string{
 	"MAIL_HOST",
 	"MAIL_PORT",
 	"MAIL_FROM",
 	"MAIL_TO",
 }
+
+// secretVars can be read from a file with the <name>_FILE convention
+var secretVars = []string{
+	"DB_URL",
+	"DB_USERNAME",
+	"DB_PASSWORD",
+	"TARGET_DB_URL",
+	"TARGET_DB_USERNAME",
+	"TARGET_DB_PASSWORD",
+	"CATALOG_DB_URL",
+	"AWS_ACCESS_KEY",
+	"AWS_SECRET_KEY",
+	"ACCESS_KEY",
+	"SECRET_KEY",
+	"GPG_PASSPHRASE",
+	"MAIL_USERNAME",
+	"MAIL_PASSWORD",
+	"SSH_PASSWORD",
+	"FTP_PASSWORD",
+	"AZURE_STORAGE_ACCOUNT_KEY",
+	"TG_TOKEN",
+	"API_TOKENS",
+	"PUSHGATEWAY_PASSWORD",
+	"WEBHOOK_SECRET",
+	"SLACK_WEBHOOK_URL",
+	"DISCORD_WEBHOOK_URL",
+	"TEAMS_WEBHOOK_URL",
+	"PAGERDUTY_ROUTING_KEY",
+	"OPSGENIE_API_KEY",
+}
 var vars = []string{
 	"TG_TOKEN",
 	"TG_CHAT_ID",
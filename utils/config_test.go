@@ -0,0 +1,67 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2023 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSecretFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db_password")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DB_PASSWORD_FILE", path)
+	t.Cleanup(func() {
+		secrets.Lock()
+		delete(secrets.values, "DB_PASSWORD")
+		secrets.Unlock()
+	})
+	if err := LoadSecretFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if got := Env("DB_PASSWORD"); got != "s3cret" {
+		t.Errorf("Env() = %q, want %q", got, "s3cret")
+	}
+	if got := ReplaceEnvVars("${DB_PASSWORD} ${UNSET_VARIABLE}"); got != "s3cret ${UNSET_VARIABLE}" {
+		t.Errorf("ReplaceEnvVars() = %q", got)
+	}
+	if _, ok := os.LookupEnv("DB_PASSWORD"); ok {
+		t.Error("the secret must not be set in the environment")
+	}
+	if os.Getenv("DB_PASSWORD_FILE") != path {
+		t.Error("DB_PASSWORD_FILE must be kept for the child processes")
+	}
+}
+
+func TestLoadSecretFilesConflict(t *testing.T) {
+	t.Setenv("DB_PASSWORD", "password")
+	t.Setenv("DB_PASSWORD_FILE", "/run/secrets/db_password")
+	if err := LoadSecretFiles(); err == nil {
+		t.Error("LoadSecretFiles() must fail when both variables are set")
+	}
+}
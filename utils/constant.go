@@ -28,8 +28,18 @@ import "os"
 
 const RestoreExample = "restore --dbname database --file db_20231219_022941.sql.gz\n" +
 	"restore --dbname database --storage s3 --path /custom-path --file db_20231219_022941.sql.gz"
+const VerifyExample = "verify --file db_20231219_022941.sql.gz\n" +
+	"verify --storage s3 --path /custom-path --file db_20231219_022941.sql.gz.gpg"
 const BackupExample = "backup --dbname database --disable-compression\n" +
 	"backup --dbname database --storage s3 --path /custom-path --disable-compression"
+const ConfigExample = "config validate --config /config/config.yaml\n" +
+	"config validate --storage s3 --test-connection\n" +
+	"config print --config /config/config.yaml"
+const ServeExample = "serve --listen :8080\n" +
+	"backup --config /config/config.yaml --api-listen :8080"
+
+const HistoryExample = "history --dbname database --status failed\n" +
+	"history --job nightly --since 7d --output json"
 
 const MainExample = "backup --dbname database --disable-compression\n" +
 	"backup --dbname database --storage s3 --path /custom-path\n" +
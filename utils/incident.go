@@ -0,0 +1,257 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2023 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+	opsgenieAPIURL     = "https://api.opsgenie.com"
+)
+
+// incidentNotifier opens an incident when a backup fails and resolves it when the next backup succeeds
+type incidentNotifier struct {
+	name    string
+	url     string
+	key     string
+	urgency string
+	open    func(n *incidentNotifier, event *Event, dedupKey string) error
+	resolve func(n *incidentNotifier, event *Event, dedupKey string) error
+}
+
+func newPagerDutyNotifier(config NotifierConfig) (Notifier, error) {
+	if config.RoutingKey == "" {
+		return nil, fmt.Errorf("routingKey is required")
+	}
+	n := &incidentNotifier{name: config.Name, url: config.URL, key: config.RoutingKey, urgency: config.Severity,
+		open: pagerDutyTrigger, resolve: pagerDutyResolve}
+	if n.url == "" {
+		n.url = pagerDutyEventsURL
+	}
+	if n.urgency == "" {
+		n.urgency = "error"
+	}
+	switch n.urgency {
+	case "critical", "error", "warning", "info":
+	default:
+		return nil, fmt.Errorf("invalid severity %q, expected critical, error, warning or info", n.urgency)
+	}
+	return n, nil
+}
+
+func newOpsgenieNotifier(config NotifierConfig) (Notifier, error) {
+	if config.APIKey == "" {
+		return nil, fmt.Errorf("apiKey is required")
+	}
+	n := &incidentNotifier{name: config.Name, url: config.URL, key: config.APIKey, urgency: config.Priority,
+		open: opsgenieCreate, resolve: opsgenieClose}
+	if n.url == "" {
+		n.url = opsgenieAPIURL
+	}
+	n.url = strings.TrimRight(n.url, "/")
+	if n.urgency == "" {
+		n.urgency = "P2"
+	}
+	switch n.urgency {
+	case "P1", "P2", "P3", "P4", "P5":
+	default:
+		return nil, fmt.Errorf("invalid priority %q, expected P1 to P5", n.urgency)
+	}
+	return n, nil
+}
+
+func (n *incidentNotifier) Name() string {
+	return n.name
+}
+
+// Notify opens the incident of a failure, a success resolves the incident of the database and storage,
+// and the incident of the database raised by the watchdog
+func (n *incidentNotifier) Notify(event *Event) error {
+	if event.Failed() {
+		if err := n.open(n, event, dedupKey(event, event.Storage)); err != nil {
+			return err
+		}
+		logger.Info("Incident has been opened", "notifier", n.name, "database", event.Database)
+		return nil
+	}
+	keys := []string{dedupKey(event, event.Storage)}
+	if event.Storage != "" {
+		keys = append(keys, dedupKey(event, ""))
+	}
+	for _, key := range keys {
+		if err := n.resolve(n, event, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dedupKey identifies the incident of a database and storage, prefixed by the backup reference when set,
+// restore, migrate and verify incidents are kept apart from the backup ones
+func dedupKey(event *Event, storage string) string {
+	parts := []string{"pg-bkup"}
+	if event.BackupReference != "" {
+		parts = append(parts, event.BackupReference)
+	}
+	if operation := event.Operation(); operation != "backup" {
+		parts = append(parts, operation)
+	}
+	if event.Database != "" {
+		parts = append(parts, event.Database)
+	}
+	if storage != "" {
+		parts = append(parts, storage)
+	}
+	return strings.Join(parts, "/")
+}
+
+// incidentDetails returns the details attached to an incident
+func incidentDetails(event *Event) map[string]string {
+	details := map[string]string{
+		"database": event.Database,
+		"error":    event.Error,
+		"time":     event.EndTime(),
+	}
+	if event.Storage != "" {
+		details["storage"] = event.Storage
+	}
+	if event.BackupReference != "" {
+		details["reference"] = event.BackupReference
+	}
+	if event.SourceFile != "" {
+		details["source_file"] = event.SourceFile
+	}
+	if event.TargetDatabase != "" {
+		details["target_database"] = event.TargetDatabase
+	}
+	return details
+}
+
+// incidentMessage returns the title of an incident
+func incidentMessage(event *Event) string {
+	switch event.Operation() {
+	case "restore":
+		return fmt.Sprintf("Restore of the %s database failed", event.Database)
+	case "migrate":
+		return fmt.Sprintf("Migration of the %s database to %s failed", event.Database, event.TargetDatabase)
+	case "verify":
+		return fmt.Sprintf("Verification of the backup %s failed", event.SourceFile)
+	}
+	return fmt.Sprintf("Backup of the %s database failed", event.Database)
+}
+
+// incidentSource returns the backup reference, or the host name
+func incidentSource(event *Event) string {
+	if event.BackupReference != "" {
+		return event.BackupReference
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "pg-bkup"
+	}
+	return host
+}
+
+// truncate shortens a value to n runes
+func truncate(value string, n int) string {
+	if runes := []rune(value); len(runes) > n {
+		return string(runes[:n-1]) + "…"
+	}
+	return value
+}
+
+// pagerDutyTrigger sends a PagerDuty Events v2 trigger, repeated triggers update the same alert
+func pagerDutyTrigger(n *incidentNotifier, event *Event, dedupKey string) error {
+	return n.pagerDutyEvent(map[string]any{
+		"routing_key":  n.key,
+		"event_action": "trigger",
+		"dedup_key":    dedupKey,
+		"payload": map[string]any{
+			"summary":        truncate(fmt.Sprintf("%s: %s", incidentMessage(event), event.Error), 1024),
+			"source":         incidentSource(event),
+			"severity":       n.urgency,
+			"timestamp":      event.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+			"component":      event.Database,
+			"group":          event.Storage,
+			"class":          event.Operation(),
+			"custom_details": incidentDetails(event),
+		},
+	})
+}
+
+// pagerDutyResolve resolves the alert of the dedup key, PagerDuty ignores unknown keys
+func pagerDutyResolve(n *incidentNotifier, _ *Event, dedupKey string) error {
+	return n.pagerDutyEvent(map[string]any{
+		"routing_key":  n.key,
+		"event_action": "resolve",
+		"dedup_key":    dedupKey,
+	})
+}
+
+func (n *incidentNotifier) pagerDutyEvent(payload map[string]any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postJSON("pagerduty", n.url, body, nil)
+}
+
+// opsgenieCreate creates an alert, Opsgenie deduplicates the open alerts with the same alias
+func opsgenieCreate(n *incidentNotifier, event *Event, dedupKey string) error {
+	body, err := json.Marshal(map[string]any{
+		"message":     truncate(incidentMessage(event), 130),
+		"alias":       truncate(dedupKey, 512),
+		"description": truncate(event.Error, 15000),
+		"priority":    n.urgency,
+		"source":      incidentSource(event),
+		"entity":      event.Database,
+		"tags":        []string{"pg-bkup", event.Operation()},
+		"details":     incidentDetails(event),
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON("opsgenie", n.url+"/v2/alerts", body, map[string]string{"Authorization": "GenieKey " + n.key})
+}
+
+// opsgenieClose closes the alert of the alias, Opsgenie ignores unknown aliases
+func opsgenieClose(n *incidentNotifier, event *Event, dedupKey string) error {
+	body, err := json.Marshal(map[string]string{
+		"source": incidentSource(event),
+		"note":   fmt.Sprintf("The %s of the %s database succeeded", event.Operation(), event.Database),
+	})
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/v2/alerts/%s/close?identifierType=alias", n.url, url.PathEscape(truncate(dedupKey, 512)))
+	return postJSON("opsgenie", endpoint, body, map[string]string{"Authorization": "GenieKey " + n.key})
+}
@@ -0,0 +1,50 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2023 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package utils
+
+import "testing"
+
+func TestDedupKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   *Event
+		storage string
+		want    string
+	}{
+		{"backup", &Event{Type: BackupFailed, Database: "shop"}, "s3", "pg-bkup/shop/s3"},
+		{"success resolves the same incident", &Event{Type: BackupSucceeded, Database: "shop"}, "s3", "pg-bkup/shop/s3"},
+		{"backup reference", &Event{Type: BackupFailed, Database: "shop", BackupReference: "paris"}, "s3", "pg-bkup/paris/shop/s3"},
+		{"restore is kept apart", &Event{Type: RestoreFailed, Database: "shop"}, "s3", "pg-bkup/restore/shop/s3"},
+		{"verify without database", &Event{Type: VerifyFailed}, "local", "pg-bkup/verify/local"},
+		{"no storage", &Event{Type: MigrationFailed, Database: "shop"}, "", "pg-bkup/migrate/shop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dedupKey(tt.event, tt.storage); got != tt.want {
+				t.Errorf("dedupKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2023 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package utils
+
+import (
+	"io"
+	"log"
+	"sync"
+)
+
+// maxCapturedLogs bounds the log output kept in memory
+const maxCapturedLogs = 1 << 20
+
+// logCapture keeps the recent log output, attached to the failure notifications
+type logCapture struct {
+	mu sync.Mutex
+	// buf holds the last bytes of the output, written is the total number of bytes written
+	buf     []byte
+	written int64
+}
+
+var capturedLogs = &logCapture{}
+
+var captureOnce sync.Once
+
+// CaptureLogs keeps the recent log output in memory, in addition to writing it
+func CaptureLogs() {
+	captureOnce.Do(func() {
+		log.SetOutput(io.MultiWriter(log.Writer(), capturedLogs))
+	})
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = append(c.buf, p...)
+	c.written += int64(len(p))
+	if len(c.buf) > maxCapturedLogs {
+		c.buf = append([]byte(nil), c.buf[len(c.buf)-maxCapturedLogs:]...)
+	}
+	return len(p), nil
+}
+
+// LogMark returns the current position of the log output, see LogsSince
+func LogMark() int64 {
+	capturedLogs.mu.Lock()
+	defer capturedLogs.mu.Unlock()
+	return capturedLogs.written
+}
+
+// LogsSince returns the log output written since the mark, it includes the logs of concurrent runs
+func LogsSince(mark int64) []byte {
+	c := capturedLogs
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := int64(len(c.buf)) - (c.written - mark)
+	if start < 0 {
+		start = 0
+	}
+	return append([]byte(nil), c.buf[start:]...)
+}
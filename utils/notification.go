@@ -35,14 +35,16 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
-	"time"
 )
 
+// parseTemplate renders an HTML template
 func parseTemplate[T any](data T, fileName string) (string, error) {
-	// Open the file
-	tmpl, err := template.ParseFiles(filepath.Join(templatePath, fileName))
+	text, err := readTemplate(fileName)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(fileName).Parse(text)
 	if err != nil {
 		return "", err
 	}
@@ -56,16 +58,52 @@ func parseTemplate[T any](data T, fileName string) (string, error) {
 }
 
 func SendEmail(subject, body string) error {
+	return sendEmail(&emailMessage{subject: subject, body: body})
+}
+
+// emailMessage is an email, recipients are comma-separated addresses
+type emailMessage struct {
+	// to, cc and bcc default to MAIL_TO, MAIL_CC and MAIL_BCC when empty
+	to  string
+	cc  string
+	bcc string
+	// subject and the HTML body
+	subject string
+	body    string
+	// textBody is sent as the plain text alternative of the HTML body when set
+	textBody    string
+	attachments []Attachment
+}
+
+// sendEmail sends an email with the MAIL_* server settings
+func sendEmail(message *emailMessage) error {
 	logger.Info("Start sending email notification....")
 	config := loadMailConfig()
-	emails := strings.Split(config.MailTo, ",")
+	d, err := newMailDialer(config)
+	if err != nil {
+		return err
+	}
 	m := mail.NewMessage()
 	m.SetHeader("From", config.MailFrom)
-	m.SetHeader("To", emails...)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", body)
-	d := mail.NewDialer(config.MailHost, config.MailPort, config.MailUserName, config.MailPassword)
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: config.SkipTls}
+	m.SetHeader("To", mailAddresses(message.to, config.MailTo)...)
+	if cc := mailAddresses(message.cc, config.MailCc); len(cc) > 0 {
+		m.SetHeader("Cc", cc...)
+	}
+	if bcc := mailAddresses(message.bcc, config.MailBcc); len(bcc) > 0 {
+		m.SetHeader("Bcc", bcc...)
+	}
+	m.SetHeader("Subject", message.subject)
+	if message.textBody != "" {
+		m.SetBody("text/plain", message.textBody)
+		m.AddAlternative("text/html", message.body)
+	} else {
+		m.SetBody("text/html", message.body)
+	}
+	for _, attachment := range message.attachments {
+		m.AttachReader(attachment.Name, bytes.NewReader(attachment.Content), mail.SetHeader(map[string][]string{
+			"Content-Type": {"text/plain; charset=UTF-8"},
+		}))
+	}
 
 	if err := d.DialAndSend(m); err != nil {
 		logger.Error("Error could not send email", "error", err)
@@ -75,10 +113,47 @@ func SendEmail(subject, body string) error {
 	return nil
 
 }
-func sendMessage(msg string) error {
+
+// newMailDialer returns the SMTP dialer of the MAIL_TLS mode
+func newMailDialer(config *MailConfig) (*mail.Dialer, error) {
+	d := mail.NewDialer(config.MailHost, config.MailPort, config.MailUserName, config.MailPassword)
+	switch config.TLS {
+	case "":
+		// Implicit TLS on port 465, STARTTLS when the server supports it otherwise
+	case "none":
+		d.SSL = false
+		d.StartTLSPolicy = mail.NoStartTLS
+	case "starttls":
+		d.SSL = false
+		d.StartTLSPolicy = mail.MandatoryStartTLS
+	case "tls":
+		d.SSL = true
+	default:
+		return nil, fmt.Errorf("unknown MAIL_TLS mode %q, expected none, starttls or tls", config.TLS)
+	}
+	d.TLSConfig = &tls.Config{ServerName: config.MailHost, InsecureSkipVerify: config.SkipTls}
+	return d, nil
+}
+
+// mailAddresses splits comma-separated addresses, or the default ones when empty
+func mailAddresses(addresses, defaultAddresses string) []string {
+	if strings.TrimSpace(addresses) == "" {
+		addresses = defaultAddresses
+	}
+	var list []string
+	for _, address := range strings.Split(addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			list = append(list, address)
+		}
+	}
+	return list
+}
+func sendMessage(chatId, msg string) error {
 
 	logger.Info("Sending Telegram notification... ")
-	chatId := os.Getenv("TG_CHAT_ID")
+	if chatId == "" {
+		chatId = os.Getenv("TG_CHAT_ID")
+	}
 	body, _ := json.Marshal(map[string]string{
 		"chat_id": chatId,
 		"text":    msg,
@@ -106,75 +181,150 @@ func sendMessage(msg string) error {
 	}
 
 }
-func NotifySuccess(notificationData *NotificationData) {
-	notificationData.BackupReference = backupReference()
-	// Email notification
-	err := CheckEnvVars(mailVars)
-	if err == nil {
-		body, err := parseTemplate(*notificationData, "email.tmpl")
-		if err != nil {
-			logger.Error("Could not parse email template", "error", err)
-		}
-		err = SendEmail(fmt.Sprintf("✅  Database Backup Notification – %s", notificationData.Database), body)
+
+// emailNotifier sends HTML emails with the MAIL_* settings
+type emailNotifier struct {
+	name       string
+	to         string
+	cc         string
+	bcc        string
+	attachLogs bool
+	templates  notifierTemplates
+}
+
+func newEmailNotifier(config NotifierConfig) (Notifier, error) {
+	required := mailVars
+	if config.To != "" {
+		required = []string{"MAIL_HOST", "MAIL_PORT", "MAIL_FROM"}
+	}
+	if err := CheckEnvVars(required); err != nil {
+		return nil, err
+	}
+	mailConfig := loadMailConfig()
+	if _, err := newMailDialer(mailConfig); err != nil {
+		return nil, err
+	}
+	n := &emailNotifier{name: config.Name, to: config.To, cc: config.Cc, bcc: config.Bcc, attachLogs: mailConfig.AttachLogs}
+	if config.AttachLogs != nil {
+		n.attachLogs = *config.AttachLogs
+	}
+	n.templates = newNotifierTemplates("email", config)
+	return n, nil
+}
+
+func (n *emailNotifier) Name() string {
+	return n.name
+}
+
+func (n *emailNotifier) Notify(event *Event) error {
+	templateName := n.templates.name(event)
+	body, err := parseTemplate(event, templateName)
+	if err != nil {
+		logger.Error("Could not parse email template", "template", templateName, "error", err)
+		body = event.Summary()
+	}
+	// The plain text alternative of <name>.tmpl is <name>.txt.tmpl, a built-in alternative
+	// is not sent with an overridden HTML template
+	var textBody string
+	textName := strings.TrimSuffix(templateName, ".tmpl") + ".txt.tmpl"
+	if templateExists(textName) && templateOverridden(textName) == templateOverridden(templateName) {
+		textBody, err = parseTextTemplate(event, textName)
 		if err != nil {
-			logger.Error("Could not send email", "error", err)
+			logger.Error("Could not parse email template", "template", textName, "error", err)
+			textBody = ""
 		}
 	}
-	// Telegram notification
-	err = CheckEnvVars(vars)
-	if err == nil {
-		message, err := parseTemplate(*notificationData, "telegram.tmpl")
-		if err != nil {
-			logger.Error("Could not parse telegram template", "error", err)
+	message := &emailMessage{to: n.to, cc: n.cc, bcc: n.bcc, subject: event.Title(), body: body, textBody: textBody}
+	// The recipients of a database replace the ones of the notifier
+	if recipients := event.Recipients; recipients != nil {
+		if recipients.MailTo != "" {
+			message.to = recipients.MailTo
 		}
-
-		err = sendMessage(message)
-		if err != nil {
-			logger.Error("Could not send Telegram message", "error", err)
+		if recipients.MailCc != "" {
+			message.cc = recipients.MailCc
 		}
+		if recipients.MailBcc != "" {
+			message.bcc = recipients.MailBcc
+		}
+	}
+	if n.attachLogs && event.Failed() {
+		message.attachments = event.Attachments
 	}
+	return sendEmail(message)
 }
-func NotifyError(error string) {
 
-	// Email notification
-	err := CheckEnvVars(mailVars)
-	if err == nil {
-		body, err := parseTemplate(ErrorMessage{
-			Error:           error,
-			EndTime:         time.Now().Format(TimeFormat()),
-			BackupReference: os.Getenv("BACKUP_REFERENCE"),
-			DatabaseName:    DatabaseName,
-		}, "email-error.tmpl")
-		if err != nil {
-			logger.Error("Could not parse error template", "error", err)
-		}
-		err = SendEmail("🔴 Urgent: Database Backup Failure Notification", body)
-		if err != nil {
-			logger.Error("Could not send email", "error", err)
-		}
+// telegramNotifier sends messages with the TG_TOKEN bot
+type telegramNotifier struct {
+	name      string
+	chatID    string
+	templates notifierTemplates
+}
+
+func newTelegramNotifier(config NotifierConfig) (Notifier, error) {
+	if Env("TG_TOKEN") == "" {
+		return nil, fmt.Errorf("TG_TOKEN environment variable is required")
 	}
-	// Telegram notification
-	err = CheckEnvVars(vars)
-	if err == nil {
-		message, err := parseTemplate(ErrorMessage{
-			Error:           error,
-			EndTime:         time.Now().Format(TimeFormat()),
-			BackupReference: os.Getenv("BACKUP_REFERENCE"),
-			DatabaseName:    DatabaseName,
-		}, "telegram-error.tmpl")
-		if err != nil {
-			logger.Error("Could not parse error template", "error", err)
+	if config.ChatID == "" && os.Getenv("TG_CHAT_ID") == "" {
+		return nil, fmt.Errorf("chatId or the TG_CHAT_ID environment variable is required")
+	}
+	n := &telegramNotifier{name: config.Name, chatID: config.ChatID}
+	n.templates = newNotifierTemplates("telegram", config)
+	return n, nil
+}
 
-		}
+func (n *telegramNotifier) Name() string {
+	return n.name
+}
 
-		err = sendMessage(message)
-		if err != nil {
-			logger.Error("Could not send telegram message", "error", err)
-		}
+func (n *telegramNotifier) Notify(event *Event) error {
+	templateName := n.templates.name(event)
+	message, err := parseTextTemplate(event, templateName)
+	if err != nil {
+		logger.Error("Could not parse telegram template", "template", templateName, "error", err)
+		message = event.Summary()
 	}
+	chatID := n.chatID
+	if event.Recipients != nil && event.Recipients.TelegramChatId != "" {
+		chatID = event.Recipients.TelegramChatId
+	}
+	return sendMessage(chatID, message)
+}
+
+// NotifySuccess sends the notification of a successful backup
+func NotifySuccess(notificationData *NotificationData) {
+	Notify(&Event{
+		Type:            BackupSucceeded,
+		Database:        notificationData.Database,
+		Storage:         notificationData.Storage,
+		File:            notificationData.File,
+		BackupSize:      notificationData.BackupSize,
+		BackupLocation:  notificationData.BackupLocation,
+		Duration:        notificationData.Duration,
+		Recipients:      notificationData.Recipients,
+		Job:             notificationData.Job,
+		Host:            notificationData.Host,
+		ServerVersion:   notificationData.ServerVersion,
+		Checksum:        notificationData.Checksum,
+		GlobalsLocation: notificationData.GlobalsLocation,
+		NextRun:         notificationData.NextRun,
+	})
+}
+
+func NotifyError(database, error string) {
+	NotifyErrorTo(nil, database, error)
+}
+
+// NotifyErrorTo sends the error notification of a database to the given recipients, or to the default ones when nil
+func NotifyErrorTo(recipients *Recipients, database, error string) {
+	Notify(&Event{
+		Type:       BackupFailed,
+		Database:   database,
+		Error:      error,
+		Recipients: recipients,
+	})
 }
 
 func getTgUrl() string {
-	return fmt.Sprintf("https://api.telegram.org/bot%s", os.Getenv("TG_TOKEN"))
+	return fmt.Sprintf("https://api.telegram.org/bot%s", Env("TG_TOKEN"))
 
 }
@@ -0,0 +1,498 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2023 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"github.com/jkaninda/pg-bkup/templates"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// EventType is the kind of notification event
+type EventType string
+
+const (
+	BackupSucceeded    EventType = "backup.succeeded"
+	BackupFailed       EventType = "backup.failed"
+	RestoreSucceeded   EventType = "restore.succeeded"
+	RestoreFailed      EventType = "restore.failed"
+	MigrationSucceeded EventType = "migrate.succeeded"
+	MigrationFailed    EventType = "migrate.failed"
+	VerifySucceeded    EventType = "verify.succeeded"
+	VerifyFailed       EventType = "verify.failed"
+	// BackupDigest summarizes the backups of a job, it is only sent to the digest notifiers
+	BackupDigest EventType = "backup.digest"
+)
+
+// Event is sent to every notifier, it is also the data of the templates
+type Event struct {
+	Type            EventType
+	Database        string
+	Storage         string
+	File            string
+	BackupSize      string
+	BackupLocation  string
+	Duration        string
+	Error           string
+	BackupReference string
+	Time            time.Time
+	Recipients      *Recipients
+	// SourceFile is the backup file of a restore
+	SourceFile string
+	// TargetDatabase is the database a backup is restored or migrated to
+	TargetDatabase string
+	// Rows is the number of rows restored or migrated
+	Rows int64
+	// Job is the backup job of the event, its backups are summarized by a digest event
+	Job string
+	// Runs are the backups of a digest event
+	Runs []RunSummary
+	// Suppressed is the number of failures of the database throttled since the last notification
+	Suppressed int
+	// Host is the database host
+	Host string
+	// ServerVersion is the PostgreSQL server version
+	ServerVersion string
+	// Checksum is the SHA-256 checksum of the backup file
+	Checksum string
+	// GlobalsLocation is the location of the roles and tablespaces dumped with the backup
+	GlobalsLocation string
+	// NextRun is the next scheduled run of the backup, zero when not scheduled
+	NextRun time.Time
+	// Attachments of a failure, such as the command output and the run log, sent by email
+	Attachments []Attachment
+}
+
+// Attachment is a text file attached to a notification
+type Attachment struct {
+	Name    string
+	Content []byte
+}
+
+// RunSummary is a backup of a digest event
+type RunSummary struct {
+	Database   string
+	Storage    string
+	File       string
+	BackupSize string
+	Duration   string
+	Error      string
+}
+
+// Status returns the status of the backup: succeeded or failed
+func (r RunSummary) Status() string {
+	if r.Error != "" {
+		return "failed"
+	}
+	return "succeeded"
+}
+
+// Failed reports whether the event is a failure, or a digest with a failed backup
+func (e *Event) Failed() bool {
+	if e.Type == BackupDigest {
+		return e.FailedCount() > 0
+	}
+	return strings.HasSuffix(string(e.Type), ".failed")
+}
+
+// FailedCount returns the number of failed backups of a digest event
+func (e *Event) FailedCount() int {
+	failed := 0
+	for _, run := range e.Runs {
+		if run.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// SucceededCount returns the number of successful backups of a digest event
+func (e *Event) SucceededCount() int {
+	return len(e.Runs) - e.FailedCount()
+}
+
+// Operation returns the operation of the event: backup, restore, migrate or verify
+func (e *Event) Operation() string {
+	operation, _, _ := strings.Cut(string(e.Type), ".")
+	return operation
+}
+
+// DatabaseName returns the database name, kept for the templates written before Event
+func (e *Event) DatabaseName() string {
+	return e.Database
+}
+
+// NextRunTime returns the next scheduled run in the TIME_FORMAT format, empty when not scheduled
+func (e *Event) NextRunTime() string {
+	if e.NextRun.IsZero() {
+		return ""
+	}
+	return e.NextRun.Format(TimeFormat())
+}
+
+// Hostname returns the host name of the machine running pg-bkup
+func (e *Event) Hostname() string {
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// Version returns the pg-bkup version
+func (e *Event) Version() string {
+	if version := FullVersion(); version != "" {
+		return version
+	}
+	return "dev"
+}
+
+// EndTime returns the time of the event in the TIME_FORMAT format
+func (e *Event) EndTime() string {
+	return e.Time.Format(TimeFormat())
+}
+
+// Title returns the subject of the notification
+func (e *Event) Title() string {
+	switch e.Type {
+	case BackupFailed:
+		return fmt.Sprintf("🔴 Urgent: Database Backup Failure Notification – %s", e.Database)
+	case RestoreSucceeded:
+		return fmt.Sprintf("✅ Database Restore Notification – %s", e.Database)
+	case RestoreFailed:
+		return fmt.Sprintf("🔴 Urgent: Database Restore Failure Notification – %s", e.Database)
+	case MigrationSucceeded:
+		return fmt.Sprintf("✅ Database Migration Notification – %s → %s", e.Database, e.TargetDatabase)
+	case MigrationFailed:
+		return fmt.Sprintf("🔴 Urgent: Database Migration Failure Notification – %s → %s", e.Database, e.TargetDatabase)
+	case VerifySucceeded:
+		return fmt.Sprintf("✅ Backup Verification Notification – %s", e.SourceFile)
+	case VerifyFailed:
+		return fmt.Sprintf("🔴 Urgent: Backup Verification Failure Notification – %s", e.SourceFile)
+	case BackupDigest:
+		if e.Failed() {
+			return fmt.Sprintf("🔴 Database Backup Summary – %s: %d failed, %d succeeded", e.Job, e.FailedCount(), e.SucceededCount())
+		}
+		return fmt.Sprintf("✅ Database Backup Summary – %s: %d succeeded", e.Job, e.SucceededCount())
+	}
+	return fmt.Sprintf("✅ Database Backup Notification – %s", e.Database)
+}
+
+// Summary returns a short message, used when a template cannot be read
+func (e *Event) Summary() string {
+	switch {
+	case e.Type == BackupDigest:
+		var b strings.Builder
+		b.WriteString(e.Title())
+		for _, run := range e.Runs {
+			_, _ = fmt.Fprintf(&b, "\n%s (%s): %s", run.Database, run.Storage, run.Status())
+			if run.Error != "" {
+				_, _ = fmt.Fprintf(&b, ", %s", run.Error)
+			} else {
+				_, _ = fmt.Fprintf(&b, ", %s in %s", run.BackupSize, run.Duration)
+			}
+		}
+		return b.String()
+	case e.Failed():
+		return fmt.Sprintf("%s\nError: %s", e.Title(), e.Error)
+	case e.Type == RestoreSucceeded:
+		return fmt.Sprintf("%s\nThe backup %s has been restored to %s in %s, %d rows", e.Title(), e.SourceFile, e.Database, e.Duration, e.Rows)
+	case e.Type == MigrationSucceeded:
+		return fmt.Sprintf("%s\nThe %s database has been migrated to %s in %s, %d rows", e.Title(), e.Database, e.TargetDatabase, e.Duration, e.Rows)
+	case e.Type == VerifySucceeded:
+		return fmt.Sprintf("%s\nThe backup %s (%s) has been verified in %s", e.Title(), e.SourceFile, e.BackupSize, e.Duration)
+	}
+	return fmt.Sprintf("%s\nThe backup %s (%s) has been saved to %s in %s", e.Title(), e.File, e.BackupSize, e.BackupLocation, e.Duration)
+}
+
+// Notifier sends the notifications of a channel
+type Notifier interface {
+	Name() string
+	Notify(event *Event) error
+}
+
+// NotifierConfig configures a notification channel of the notifications block
+type NotifierConfig struct {
+	// Type is the kind of notifier: email, telegram, webhook, slack, discord, teams, pagerduty or opsgenie
+	Type string `yaml:"type"`
+	// Name identifies the notifier in the logs, defaults to the type
+	Name string `yaml:"name"`
+	// URL is the webhook URL of the webhook, slack, discord and teams notifiers,
+	// or overrides the API URL of the pagerduty and opsgenie notifiers
+	URL string `yaml:"url"`
+	// Secret signs the webhook payloads with HMAC-SHA256
+	Secret string `yaml:"secret"`
+	// Headers are added to the webhook requests
+	Headers map[string]string `yaml:"headers"`
+	// To, Cc and Bcc override MAIL_TO, MAIL_CC and MAIL_BCC for the email notifier
+	To  string `yaml:"to"`
+	Cc  string `yaml:"cc"`
+	Bcc string `yaml:"bcc"`
+	// AttachLogs attaches the command output and the run log to the failure emails, overrides MAIL_ATTACH_LOGS
+	AttachLogs *bool `yaml:"attachLogs"`
+	// ChatID overrides TG_CHAT_ID for the telegram notifier
+	ChatID string `yaml:"chatId"`
+	// RoutingKey is the integration key of the pagerduty notifier
+	RoutingKey string `yaml:"routingKey"`
+	// Severity of the PagerDuty alerts: critical, error (default), warning or info
+	Severity string `yaml:"severity"`
+	// APIKey is the API key of the opsgenie notifier
+	APIKey string `yaml:"apiKey"`
+	// Priority of the Opsgenie alerts, from P1 to P5 (default P2)
+	Priority string `yaml:"priority"`
+	// Template and ErrorTemplate override the template files of the backup notifications
+	Template      string `yaml:"template"`
+	ErrorTemplate string `yaml:"errorTemplate"`
+	// On selects the events sent to the notifier: failure, success or always (default), overrides NOTIFY_ON
+	On string `yaml:"on"`
+	// Digest replaces the notifications of the backups of a job by a summary, overrides NOTIFY_DIGEST
+	Digest *bool `yaml:"digest"`
+	// Throttle is the minimum delay between the failure notifications of a database, overrides NOTIFY_THROTTLE
+	Throttle string `yaml:"throttle"`
+}
+
+// NotifierFactory creates a notifier from its configuration
+type NotifierFactory func(config NotifierConfig) (Notifier, error)
+
+// notifierFactories is the registry of the notifier types
+var notifierFactories = map[string]NotifierFactory{
+	"email":     newEmailNotifier,
+	"telegram":  newTelegramNotifier,
+	"webhook":   newWebhookFactory("webhook", webhookPayload),
+	"slack":     newWebhookFactory("slack", slackPayload),
+	"discord":   newWebhookFactory("discord", discordPayload),
+	"teams":     newWebhookFactory("teams", teamsPayload),
+	"pagerduty": newPagerDutyNotifier,
+	"opsgenie":  newOpsgenieNotifier,
+}
+
+var (
+	notifiersMu  sync.Mutex
+	notifiers    []Notifier
+	notifiersSet bool
+)
+
+// SetNotifiers configures the notifiers of the environment variables and of the notifications block
+func SetNotifiers(configs []NotifierConfig) error {
+	list, err := newNotifiers(append(envNotifierConfigs(), configs...))
+	if err != nil {
+		return err
+	}
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	notifiers = list
+	notifiersSet = true
+	return nil
+}
+
+// ValidateNotifiers checks the notifiers of the environment variables and of the notifications block
+func ValidateNotifiers(configs []NotifierConfig) error {
+	_, err := newNotifiers(append(envNotifierConfigs(), configs...))
+	return err
+}
+
+// activeNotifiers returns the configured notifiers, or the notifiers of the environment variables
+func activeNotifiers() []Notifier {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	if !notifiersSet {
+		list, err := newNotifiers(envNotifierConfigs())
+		if err != nil {
+			logger.Error("Error configuring notifications", "error", err)
+		}
+		notifiers = list
+		notifiersSet = true
+	}
+	return notifiers
+}
+
+// newNotifiers creates the notifiers, invalid ones are skipped and reported
+func newNotifiers(configs []NotifierConfig) ([]Notifier, error) {
+	var list []Notifier
+	var errs []string
+	for _, config := range configs {
+		config.Type = strings.ToLower(config.Type)
+		if config.Name == "" {
+			config.Name = config.Type
+		}
+		factory, ok := notifierFactories[config.Type]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("notifier %q: unknown type %q, expected email, telegram, webhook, slack, discord, teams, pagerduty or opsgenie", config.Name, config.Type))
+			continue
+		}
+		notifier, err := factory(config)
+		if err == nil {
+			notifier, err = newPolicyNotifier(notifier, config)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("notifier %q: %v", config.Name, err))
+			continue
+		}
+		list = append(list, notifier)
+	}
+	if len(errs) > 0 {
+		return list, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return list, nil
+}
+
+// envNotifierConfigs returns the notifiers defined by environment variables
+func envNotifierConfigs() []NotifierConfig {
+	var configs []NotifierConfig
+	if CheckEnvVars(mailVars) == nil {
+		configs = append(configs, NotifierConfig{Type: "email"})
+	}
+	if CheckEnvVars(vars) == nil {
+		configs = append(configs, NotifierConfig{Type: "telegram"})
+	}
+	if url := os.Getenv("WEBHOOK_URL"); url != "" {
+		configs = append(configs, NotifierConfig{Type: "webhook", URL: url, Secret: Env("WEBHOOK_SECRET")})
+	}
+	for _, kind := range []string{"slack", "discord", "teams"} {
+		if url := Env(strings.ToUpper(kind) + "_WEBHOOK_URL"); url != "" {
+			configs = append(configs, NotifierConfig{Type: kind, URL: url})
+		}
+	}
+	if key := Env("PAGERDUTY_ROUTING_KEY"); key != "" {
+		configs = append(configs, NotifierConfig{Type: "pagerduty", RoutingKey: key, Severity: os.Getenv("PAGERDUTY_SEVERITY")})
+	}
+	if key := Env("OPSGENIE_API_KEY"); key != "" {
+		configs = append(configs, NotifierConfig{Type: "opsgenie", APIKey: key, URL: os.Getenv("OPSGENIE_API_URL"), Priority: os.Getenv("OPSGENIE_PRIORITY")})
+	}
+	return configs
+}
+
+// Notify sends the event to every notifier, errors are logged only
+func Notify(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.BackupReference == "" {
+		event.BackupReference = backupReference()
+	}
+	for _, notifier := range activeNotifiers() {
+		if err := notifier.Notify(event); err != nil {
+			logger.Error("Could not send notification", "notifier", notifier.Name(), "error", err)
+		}
+	}
+}
+
+// notifierTemplates selects the template file of an event
+type notifierTemplates struct {
+	kind          string
+	template      string
+	errorTemplate string
+}
+
+// newNotifierTemplates returns the templates of a notifier type, unless overridden by its configuration
+func newNotifierTemplates(kind string, config NotifierConfig) notifierTemplates {
+	t := notifierTemplates{kind: kind, template: kind + ".tmpl", errorTemplate: kind + "-error.tmpl"}
+	if config.Template != "" {
+		t.template = config.Template
+	}
+	if config.ErrorTemplate != "" {
+		t.errorTemplate = config.ErrorTemplate
+	}
+	return t
+}
+
+// name returns the template file of an event. Restore, migrate and verify events use the <kind>-<operation>[-error].tmpl
+// template of the notifier when it exists, or the <operation>[-error].tmpl template shared by all notifiers,
+// digest events use <kind>-digest.tmpl or digest.tmpl
+func (t notifierTemplates) name(event *Event) string {
+	if event.Type == BackupDigest {
+		if name := t.kind + "-digest.tmpl"; templateExists(name) {
+			return name
+		}
+		return "digest.tmpl"
+	}
+	operation := event.Operation()
+	if operation == "backup" {
+		if event.Failed() {
+			return t.errorTemplate
+		}
+		return t.template
+	}
+	if event.Failed() {
+		operation += "-error"
+	}
+	if name := t.kind + "-" + operation + ".tmpl"; templateExists(name) {
+		return name
+	}
+	return operation + ".tmpl"
+}
+
+// readTemplate returns a template of the templates directory, or the built-in template of the same name
+func readTemplate(fileName string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(templatesDir(), fileName))
+	if err == nil {
+		return string(data), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	data, err = fs.ReadFile(templates.FS, fileName)
+	if err != nil {
+		return "", fmt.Errorf("template %s not found in %s or in the built-in templates", fileName, templatesDir())
+	}
+	return string(data), nil
+}
+
+// templateExists reports whether a template is defined in the templates directory or built in
+func templateExists(fileName string) bool {
+	if templateOverridden(fileName) {
+		return true
+	}
+	_, err := fs.Stat(templates.FS, fileName)
+	return err == nil
+}
+
+// templateOverridden reports whether a template is defined in the templates directory
+func templateOverridden(fileName string) bool {
+	return FileExists(filepath.Join(templatesDir(), fileName))
+}
+
+// parseTextTemplate renders a template without HTML escaping, for chat and webhook messages
+func parseTextTemplate[T any](data T, fileName string) (string, error) {
+	text, err := readTemplate(fileName)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(fileName).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
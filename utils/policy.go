@@ -0,0 +1,185 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2023 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package utils
+
+import (
+	"fmt"
+	"github.com/jkaninda/logger"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification policies of the on field
+const (
+	notifyAlways  = "always"
+	notifyFailure = "failure"
+	notifySuccess = "success"
+)
+
+// policyNotifier filters the events sent to a notifier according to its policy
+type policyNotifier struct {
+	Notifier
+	on       string
+	digest   bool
+	throttle time.Duration
+
+	mu        sync.Mutex
+	throttled map[string]*throttleState
+}
+
+// throttleState tracks the failures of a database sent to a throttled notifier
+type throttleState struct {
+	sent       time.Time
+	suppressed int
+}
+
+// isIncidentNotifier reports whether a notifier type opens incidents, which successes resolve
+func isIncidentNotifier(kind string) bool {
+	return kind == "pagerduty" || kind == "opsgenie"
+}
+
+// newPolicyNotifier applies the policy of a notifier configuration, defaults come from NOTIFY_ON, NOTIFY_DIGEST and NOTIFY_THROTTLE.
+// Incident notifiers receive every event so that successes resolve the incidents, they ignore these defaults
+func newPolicyNotifier(notifier Notifier, config NotifierConfig) (Notifier, error) {
+	n := &policyNotifier{Notifier: notifier, on: strings.ToLower(config.On), throttled: map[string]*throttleState{}}
+	if isIncidentNotifier(config.Type) {
+		if config.On != "" {
+			return nil, fmt.Errorf("on is not supported by %s notifiers, successes resolve the incidents", config.Type)
+		}
+		if config.Digest != nil && *config.Digest {
+			return nil, fmt.Errorf("digest is not supported by %s notifiers", config.Type)
+		}
+		n.on = notifyAlways
+		if err := n.setThrottle(config.Throttle); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	if n.on == "" {
+		n.on = strings.ToLower(EnvWithDefault("NOTIFY_ON", notifyAlways))
+	}
+	switch n.on {
+	case notifyAlways, notifyFailure, notifySuccess:
+	default:
+		return nil, fmt.Errorf("unknown notification policy %q, expected failure, success or always", n.on)
+	}
+	if config.Digest != nil {
+		n.digest = *config.Digest
+	} else if value := os.Getenv("NOTIFY_DIGEST"); value != "" {
+		digest, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NOTIFY_DIGEST %q: %v", value, err)
+		}
+		n.digest = digest
+	}
+	throttle := config.Throttle
+	if throttle == "" {
+		throttle = os.Getenv("NOTIFY_THROTTLE")
+	}
+	if err := n.setThrottle(throttle); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// setThrottle sets the throttle period, an empty value disables throttling
+func (n *policyNotifier) setThrottle(throttle string) error {
+	if throttle == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(throttle)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid throttle %q, expected a duration such as 30m or 6h", throttle)
+	}
+	n.throttle = d
+	return nil
+}
+
+// Notify sends the event when the policy accepts it
+func (n *policyNotifier) Notify(event *Event) error {
+	if !n.accepts(event) {
+		return nil
+	}
+	if n.throttle > 0 && event.Failed() && event.Type != BackupDigest {
+		suppressed, ok := n.allow(event)
+		if !ok {
+			logger.Info("Notification throttled", "notifier", n.Name(), "event", event.Type, "database", event.Database)
+			return nil
+		}
+		throttledEvent := *event
+		throttledEvent.Suppressed = suppressed
+		event = &throttledEvent
+	}
+	return n.Notifier.Notify(event)
+}
+
+// accepts reports whether the event matches the policy. Digest notifiers receive the digest
+// instead of the backups of a job, the other notifiers never receive digests
+func (n *policyNotifier) accepts(event *Event) bool {
+	if event.Type == BackupDigest {
+		if !n.digest || len(event.Runs) == 0 {
+			return false
+		}
+	} else if n.digest && event.Operation() == "backup" && event.Job != "" {
+		return false
+	}
+	switch n.on {
+	case notifyFailure:
+		return event.Failed()
+	case notifySuccess:
+		return !event.Failed()
+	}
+	return true
+}
+
+// allow reports whether a failure can be sent, the failures of a database and storage are sent once per throttle period.
+// The error is not part of the key, it often holds timestamps or file names.
+// It returns the number of failures suppressed since the last one sent
+func (n *policyNotifier) allow(event *Event) (int, bool) {
+	key := strings.Join([]string{string(event.Type), event.BackupReference, event.Database, event.Storage}, "\x00")
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	// Expired failures are forgotten, unless their suppressed count is still to be reported
+	for k, state := range n.throttled {
+		if now.Sub(state.sent) >= n.throttle && state.suppressed == 0 {
+			delete(n.throttled, k)
+		}
+	}
+	state, ok := n.throttled[key]
+	if ok && now.Sub(state.sent) < n.throttle {
+		state.suppressed++
+		return 0, false
+	}
+	suppressed := 0
+	if ok {
+		suppressed = state.suppressed
+	}
+	n.throttled[key] = &throttleState{sent: now}
+	return suppressed, true
+}
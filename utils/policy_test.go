@@ -0,0 +1,159 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2023 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// recordingNotifier keeps the events it receives
+type recordingNotifier struct {
+	events []*Event
+}
+
+func (r *recordingNotifier) Name() string { return "recording" }
+
+func (r *recordingNotifier) Notify(event *Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestPolicyNotifierAccepts(t *testing.T) {
+	failed := &Event{Type: BackupFailed, Database: "shop"}
+	succeeded := &Event{Type: BackupSucceeded, Database: "shop"}
+	jobBackup := &Event{Type: BackupSucceeded, Database: "shop", Job: "nightly"}
+	restore := &Event{Type: RestoreSucceeded, Database: "shop", Job: "nightly"}
+	digest := &Event{Type: BackupDigest, Job: "nightly", Runs: []RunSummary{{Database: "shop"}}}
+	failedDigest := &Event{Type: BackupDigest, Job: "nightly", Runs: []RunSummary{{Database: "shop", Error: "failed"}}}
+	emptyDigest := &Event{Type: BackupDigest, Job: "nightly"}
+	tests := []struct {
+		name   string
+		on     string
+		digest bool
+		event  *Event
+		want   bool
+	}{
+		{"always sends failures", notifyAlways, false, failed, true},
+		{"always sends successes", notifyAlways, false, succeeded, true},
+		{"failure skips successes", notifyFailure, false, succeeded, false},
+		{"failure sends failures", notifyFailure, false, failed, true},
+		{"success skips failures", notifySuccess, false, failed, false},
+		{"no digest without digest policy", notifyAlways, false, digest, false},
+		{"digest replaces job backups", notifyAlways, true, jobBackup, false},
+		{"digest keeps backups outside jobs", notifyAlways, true, succeeded, true},
+		{"digest keeps restores", notifyAlways, true, restore, true},
+		{"digest is sent", notifyAlways, true, digest, true},
+		{"empty digest is not sent", notifyAlways, true, emptyDigest, false},
+		{"successful digest skipped on failure", notifyFailure, true, digest, false},
+		{"failed digest sent on failure", notifyFailure, true, failedDigest, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &policyNotifier{on: tt.on, digest: tt.digest}
+			if got := n.accepts(tt.event); got != tt.want {
+				t.Errorf("accepts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyNotifierDefaults(t *testing.T) {
+	t.Setenv("NOTIFY_ON", "failure")
+	t.Setenv("NOTIFY_DIGEST", "true")
+	t.Setenv("NOTIFY_THROTTLE", "1h")
+	tests := []struct {
+		name     string
+		config   NotifierConfig
+		on       string
+		digest   bool
+		throttle time.Duration
+		wantErr  bool
+	}{
+		{"environment defaults", NotifierConfig{Type: "slack"}, notifyFailure, true, time.Hour, false},
+		{"channel settings win", NotifierConfig{Type: "slack", On: "always", Throttle: "5m"}, notifyAlways, true, 5 * time.Minute, false},
+		{"incident notifiers ignore defaults", NotifierConfig{Type: "pagerduty"}, notifyAlways, false, 0, false},
+		{"incident notifier throttle", NotifierConfig{Type: "opsgenie", Throttle: "10m"}, notifyAlways, false, 10 * time.Minute, false},
+		{"incident notifiers reject on", NotifierConfig{Type: "pagerduty", On: "failure"}, "", false, 0, true},
+		{"unknown policy", NotifierConfig{Type: "slack", On: "never"}, "", false, 0, true},
+		{"invalid throttle", NotifierConfig{Type: "slack", Throttle: "often"}, "", false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier, err := newPolicyNotifier(&recordingNotifier{}, tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newPolicyNotifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			n := notifier.(*policyNotifier)
+			if n.on != tt.on || n.digest != tt.digest || n.throttle != tt.throttle {
+				t.Errorf("policy = %s, %v, %v, want %s, %v, %v", n.on, n.digest, n.throttle, tt.on, tt.digest, tt.throttle)
+			}
+		})
+	}
+}
+
+func TestPolicyNotifierThrottle(t *testing.T) {
+	recorder := &recordingNotifier{}
+	n := &policyNotifier{Notifier: recorder, on: notifyAlways, throttle: time.Hour, throttled: map[string]*throttleState{}}
+	failure := func(database, storage, err string) *Event {
+		return &Event{Type: BackupFailed, Database: database, Storage: storage, Error: err}
+	}
+	steps := []struct {
+		name       string
+		event      *Event
+		sent       bool
+		suppressed int
+	}{
+		{"first failure", failure("shop", "s3", "timeout at 02:00:01"), true, 0},
+		{"same failure with another error", failure("shop", "s3", "timeout at 02:00:07"), false, 0},
+		{"other database", failure("crm", "s3", "timeout at 02:00:01"), true, 0},
+		{"other storage", failure("shop", "local", "timeout at 02:00:01"), true, 0},
+		{"success is not throttled", &Event{Type: BackupSucceeded, Database: "shop", Storage: "s3"}, true, 0},
+		{"same failure again", failure("shop", "s3", "disk full"), false, 0},
+	}
+	for _, step := range steps {
+		sent := len(recorder.events)
+		if err := n.Notify(step.event); err != nil {
+			t.Fatalf("%s: Notify() error = %v", step.name, err)
+		}
+		if got := len(recorder.events) > sent; got != step.sent {
+			t.Fatalf("%s: sent = %v, want %v", step.name, got, step.sent)
+		}
+	}
+	// Once the period is over, the next failure reports the suppressed ones
+	for _, state := range n.throttled {
+		state.sent = state.sent.Add(-2 * time.Hour)
+	}
+	if err := n.Notify(failure("shop", "s3", "timeout")); err != nil {
+		t.Fatal(err)
+	}
+	last := recorder.events[len(recorder.events)-1]
+	if last.Database != "shop" || last.Suppressed != 2 {
+		t.Errorf("last event = %s with %d suppressed, want shop with 2", last.Database, last.Suppressed)
+	}
+}
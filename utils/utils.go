@@ -166,14 +166,11 @@ func SetEnv(key, value string) {
 	}
 }
 func GetEnvVariable(envName, oldEnvName string) string {
-	value := os.Getenv(envName)
+	value := Env(envName)
 	if value == "" {
-		value = os.Getenv(oldEnvName)
+		value = Env(oldEnvName)
 		if value != "" {
-			err := os.Setenv(envName, value)
-			if err != nil {
-				return value
-			}
+			setEnv(envName, value)
 			logger.Warn(fmt.Sprintf("Environment variable %s set to %s", oldEnvName, envName))
 		}
 	}
@@ -185,7 +182,7 @@ func CheckEnvVars(vars []string) error {
 	missingVars := []string{}
 
 	for _, v := range vars {
-		if os.Getenv(v) == "" {
+		if Env(v) == "" {
 			missingVars = append(missingVars, v)
 		}
 	}
@@ -227,7 +224,7 @@ func GetIntEnv(envName string) int {
 }
 
 func EnvWithDefault(envName string, defaultValue string) string {
-	value := os.Getenv(envName)
+	value := Env(envName)
 	if value == "" {
 		return defaultValue
 	}
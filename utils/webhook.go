@@ -0,0 +1,257 @@
+/*
+ *  MIT License
+ *
+ * Copyright (c) 2023 Jonas Kaninda
+ *
+ *  Permission is hereby granted, free of charge, to any person obtaining a copy
+ *  of this software and associated documentation files (the "Software"), to deal
+ *  in the Software without restriction, including without limitation the rights
+ *  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *  copies of the Software, and to permit persons to whom the Software is
+ *  furnished to do so, subject to the following conditions:
+ *
+ *  The above copyright notice and this permission notice shall be included in all
+ *  copies or substantial portions of the Software.
+ *
+ *  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *  SOFTWARE.
+ */
+
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/logger"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// signatureHeader holds the HMAC-SHA256 signature of the webhook payloads
+const signatureHeader = "X-Pg-Bkup-Signature-256"
+
+// discordMaxLength is the maximum length of a Discord message
+const discordMaxLength = 2000
+
+// webhookNotifier posts a JSON payload built from the rendered template of its type
+type webhookNotifier struct {
+	kind      string
+	name      string
+	url       string
+	secret    string
+	headers   map[string]string
+	templates notifierTemplates
+	payload   func(event *Event, message string) any
+}
+
+// newWebhookFactory returns the factory of a webhook notifier type
+func newWebhookFactory(kind string, payload func(event *Event, message string) any) NotifierFactory {
+	return func(config NotifierConfig) (Notifier, error) {
+		if config.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		if !strings.HasPrefix(config.URL, "https://") && !strings.HasPrefix(config.URL, "http://") {
+			return nil, fmt.Errorf("url must be an http or https URL")
+		}
+		n := &webhookNotifier{
+			kind:    kind,
+			name:    config.Name,
+			url:     config.URL,
+			secret:  config.Secret,
+			headers: config.Headers,
+			payload: payload,
+		}
+		n.templates = newNotifierTemplates(kind, config)
+		return n, nil
+	}
+}
+
+func (n *webhookNotifier) Name() string {
+	return n.name
+}
+
+func (n *webhookNotifier) Notify(event *Event) error {
+	templateName := n.templates.name(event)
+	message, err := parseTextTemplate(event, templateName)
+	if err != nil {
+		logger.Error("Could not parse notification template", "notifier", n.name, "template", templateName, "error", err)
+		message = event.Summary()
+	}
+	body, err := json.Marshal(n.payload(event, strings.TrimSpace(message)))
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{}
+	for key, value := range n.headers {
+		headers[key] = value
+	}
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		headers[signatureHeader] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	if err := postJSON(n.kind, n.url, body, headers); err != nil {
+		return err
+	}
+	logger.Info("Notification has been sent", "notifier", n.name)
+	return nil
+}
+
+// postJSON posts a JSON body, responses other than 2xx are returned as errors
+func postJSON(kind, url string, body []byte, headers map[string]string) error {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "pg-bkup/"+Version)
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode >= 300 {
+		reply, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", kind, response.Status, strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+// webhookPayload is the payload of the generic webhook
+func webhookPayload(event *Event, message string) any {
+	return struct {
+		Event           EventType    `json:"event"`
+		Database        string       `json:"database"`
+		Storage         string       `json:"storage,omitempty"`
+		File            string       `json:"file,omitempty"`
+		BackupSize      string       `json:"backupSize,omitempty"`
+		BackupLocation  string       `json:"backupLocation,omitempty"`
+		Duration        string       `json:"duration,omitempty"`
+		Error           string       `json:"error,omitempty"`
+		BackupReference string       `json:"backupReference,omitempty"`
+		SourceFile      string       `json:"sourceFile,omitempty"`
+		TargetDatabase  string       `json:"targetDatabase,omitempty"`
+		Rows            int64        `json:"rows,omitempty"`
+		Job             string       `json:"job,omitempty"`
+		Runs            []webhookRun `json:"runs,omitempty"`
+		Suppressed      int          `json:"suppressed,omitempty"`
+		Host            string       `json:"host,omitempty"`
+		ServerVersion   string       `json:"serverVersion,omitempty"`
+		Checksum        string       `json:"checksum,omitempty"`
+		GlobalsLocation string       `json:"globalsLocation,omitempty"`
+		NextRun         *time.Time   `json:"nextRun,omitempty"`
+		Version         string       `json:"version,omitempty"`
+		Time            time.Time    `json:"time"`
+		Message         string       `json:"message"`
+	}{
+		Event:           event.Type,
+		Database:        event.Database,
+		Storage:         event.Storage,
+		File:            event.File,
+		BackupSize:      event.BackupSize,
+		BackupLocation:  event.BackupLocation,
+		Duration:        event.Duration,
+		Error:           event.Error,
+		BackupReference: event.BackupReference,
+		SourceFile:      event.SourceFile,
+		TargetDatabase:  event.TargetDatabase,
+		Rows:            event.Rows,
+		Job:             event.Job,
+		Runs:            webhookRuns(event.Runs),
+		Suppressed:      event.Suppressed,
+		Host:            event.Host,
+		ServerVersion:   event.ServerVersion,
+		Checksum:        event.Checksum,
+		GlobalsLocation: event.GlobalsLocation,
+		Version:         event.Version(),
+		NextRun:         optionalTime(event.NextRun),
+		Time:            event.Time,
+		Message:         message,
+	}
+}
+
+// optionalTime returns nil for the zero time, to omit it from the payloads
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// webhookRun is a backup of a digest in the webhook payload
+type webhookRun struct {
+	Database   string `json:"database"`
+	Storage    string `json:"storage"`
+	Status     string `json:"status"`
+	File       string `json:"file,omitempty"`
+	BackupSize string `json:"backupSize,omitempty"`
+	Duration   string `json:"duration,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func webhookRuns(runs []RunSummary) []webhookRun {
+	var list []webhookRun
+	for _, run := range runs {
+		list = append(list, webhookRun{
+			Database:   run.Database,
+			Storage:    run.Storage,
+			Status:     run.Status(),
+			File:       run.File,
+			BackupSize: run.BackupSize,
+			Duration:   run.Duration,
+			Error:      run.Error,
+		})
+	}
+	return list
+}
+
+// slackPayload is the payload of a Slack incoming webhook
+func slackPayload(_ *Event, message string) any {
+	return map[string]string{"text": message}
+}
+
+// discordPayload is the payload of a Discord webhook, longer messages are truncated
+func discordPayload(_ *Event, message string) any {
+	if runes := []rune(message); len(runes) > discordMaxLength {
+		message = string(runes[:discordMaxLength-1]) + "…"
+	}
+	return map[string]string{"content": message}
+}
+
+// teamsPayload is an Adaptive Card, accepted by Teams workflows and incoming webhooks
+func teamsPayload(event *Event, message string) any {
+	color := "Good"
+	if event.Failed() {
+		color = "Attention"
+	}
+	return map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]any{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body": []map[string]any{
+					{"type": "TextBlock", "text": event.Title(), "weight": "Bolder", "size": "Medium", "color": color, "wrap": true},
+					{"type": "TextBlock", "text": message, "wrap": true},
+				},
+			},
+		}},
+	}
+}